@@ -16,10 +16,16 @@ import (
 var (
 	Client *mongo.Client
 	// Your collections:
-	SongsCollection     *mongo.Collection
-	AlbumsCollection    *mongo.Collection
-	PlaylistsCollection *mongo.Collection
-	LikesCollection     *mongo.Collection
+	SongsCollection            *mongo.Collection
+	AlbumsCollection           *mongo.Collection
+	ArtistsCollection          *mongo.Collection
+	PlaylistsCollection        *mongo.Collection
+	LikesCollection            *mongo.Collection
+	PlaylistFollowsCollection  *mongo.Collection
+	PlaylistHistoryCollection  *mongo.Collection
+	ListeningHistoryCollection *mongo.Collection
+	ChartsCollection           *mongo.Collection
+	UploadsCollection          *mongo.Collection
 )
 
 // limiter chan to cap concurrent Mongo ops
@@ -69,8 +75,14 @@ func init() {
 	db := Client.Database("eventdb")
 	SongsCollection = db.Collection("songs")
 	AlbumsCollection = db.Collection("albums")
+	ArtistsCollection = db.Collection("artists")
 	PlaylistsCollection = db.Collection("playlists")
 	LikesCollection = db.Collection("likes")
+	PlaylistFollowsCollection = db.Collection("playlist_follows")
+	PlaylistHistoryCollection = db.Collection("playlist_history")
+	ListeningHistoryCollection = db.Collection("listening_history")
+	ChartsCollection = db.Collection("charts")
+	UploadsCollection = db.Collection("upload_sessions")
 }
 
 // logPoolStats logs basic goroutine and pool stats every 60s (optional)
@@ -0,0 +1,253 @@
+// Package fuzzy matches search terms against catalog text despite typos,
+// case and diacritics. It has no database access of its own, only the
+// MongoDB filter it builds, so its matching rules can be tested directly.
+package fuzzy
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Fold lowercases s, strips diacritics and collapses everything that is
+// not a letter or digit into single spaces, so "Beyoncé" and "beyonce"
+// index and match alike.
+func Fold(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	folded = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, folded)
+	return strings.Join(strings.Fields(folded), " ")
+}
+
+// accentForms maps each ASCII letter to the Latin letters, in both cases,
+// that Fold turns into it, such as 'e' to "ÈÉÊËèéêë...".
+var accentForms = func() map[rune]string {
+	forms := map[rune]string{}
+	for r := rune(0xC0); r <= 0x24F; r++ {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if f := []rune(Fold(string(r))); len(f) == 1 && f[0] < unicode.MaxASCII {
+			forms[f[0]] += string(r)
+		}
+	}
+	return forms
+}()
+
+// foldedPattern is a case-insensitive regex for folded text s that also
+// matches stored text carrying diacritics, which the database cannot fold.
+// Spaces, left where Fold removed punctuation, match any run of
+// punctuation or none.
+func foldedPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == ' ':
+			b.WriteString(`\W*`)
+		case accentForms[r] != "":
+			b.WriteString("[" + string(r) + accentForms[r] + "]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
+
+// EditDistance returns the optimal string alignment distance between a and
+// b: the number of single-rune insertions, deletions, substitutions and
+// adjacent transpositions needed to turn one into the other.
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 {
+		return len(rb)
+	}
+	if len(rb) == 0 {
+		return len(ra)
+	}
+
+	// Three rolling rows are enough to account for transpositions
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// MaxTypos is how many edits a search term of this length tolerates. Very
+// short terms must match exactly or they would match almost anything.
+func MaxTypos(term string) int {
+	switch n := len([]rune(term)); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Filter creates a loose MongoDB pre-filter for documents whose field may
+// match term despite typos and diacritics: it matches any document sharing
+// at least one n-gram with the folded term. Candidates should then be
+// ranked and cut with Score. Terms too short to tolerate typos must appear
+// whole.
+func Filter(field, term string) bson.M {
+	folded := Fold(term)
+	typos := MaxTypos(folded)
+	var grams []string
+	for _, word := range strings.Fields(folded) {
+		grams = append(grams, ngrams(word, typos)...)
+	}
+	if typos == 0 || len(grams) == 0 {
+		if folded == "" {
+			// Nothing but punctuation: match it literally
+			return bson.M{field: bson.M{"$regex": regexp.QuoteMeta(term), "$options": "i"}}
+		}
+		return bson.M{field: bson.M{"$regex": foldedPattern(folded), "$options": "i"}}
+	}
+	patterns := make([]string, len(grams))
+	for i, g := range grams {
+		patterns[i] = foldedPattern(g)
+	}
+	return bson.M{field: bson.M{"$regex": strings.Join(patterns, "|"), "$options": "i"}}
+}
+
+// ngrams splits s into overlapping trigrams, or bigrams when s is too short
+// for some trigram to survive the given number of typos.
+func ngrams(s string, typos int) []string {
+	r := []rune(s)
+	n := gramSize(len(r), typos)
+	seen := map[string]bool{}
+	var out []string
+	for i := 0; i+n <= len(r); i++ {
+		g := string(r[i : i+n])
+		if strings.TrimSpace(g) == g && !seen[g] {
+			seen[g] = true
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// gramSize picks the longest n-gram, 3 or 2, that a term of length runes
+// keeps at least one of after typos edits. One edit destroys at most n+1
+// overlapping n-grams (a transposition touches two positions), so the term
+// needs more than typos*(n+1) of them. Four-rune terms fall short even with
+// bigrams, and only a transposition in their middle goes unmatched.
+func gramSize(length, typos int) int {
+	if length-2 > typos*4 {
+		return 3
+	}
+	return 2
+}
+
+// TermScore rates how well term matches the best word of text, from 0 (no
+// match) to 1 (exact word). Words the term is a prefix of score almost as
+// high, and typos within MaxTypos score lower the more edits they need.
+// Both sides are folded first.
+func TermScore(term, text string) float64 {
+	term = Fold(term)
+	budget := MaxTypos(term)
+	termLen := len([]rune(term))
+	best := 0.0
+	for _, word := range strings.Fields(Fold(text)) {
+		if word == term {
+			return 1
+		}
+		if strings.HasPrefix(word, term) {
+			best = max(best, 0.9)
+			continue
+		}
+		if budget == 0 {
+			continue
+		}
+		d := EditDistance(term, word)
+		// Also compare against the start of longer words, so a misspelt
+		// partial word still matches
+		if w := []rune(word); len(w) > termLen {
+			d = min(d, EditDistance(term, string(w[:termLen])))
+		}
+		if d <= budget {
+			best = max(best, 0.8*(1-float64(d)/float64(termLen)))
+		}
+	}
+	return best
+}
+
+// Score rates how well every term of query matches text, from 0 to 1. A
+// text missing a term entirely scores proportionally lower.
+func Score(query, text string) float64 {
+	terms := strings.Fields(Fold(query))
+	if len(terms) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, t := range terms {
+		total += TermScore(t, text)
+	}
+	return total / float64(len(terms))
+}
+
+// DidYouMean corrects each term of the folded query to the closest word of
+// vocabulary within MaxTypos, preferring the alphabetically first on ties.
+// It returns "" when no term needed correcting.
+func DidYouMean(query string, vocabulary []string) string {
+	words := map[string]bool{}
+	for _, v := range vocabulary {
+		for _, w := range strings.Fields(Fold(v)) {
+			words[w] = true
+		}
+	}
+
+	terms := strings.Fields(Fold(query))
+	changed := false
+	for i, t := range terms {
+		if words[t] {
+			continue
+		}
+		best, bestDist := "", MaxTypos(t)+1
+		for w := range words {
+			d := EditDistance(t, w)
+			if d < bestDist || (d == bestDist && w < best) {
+				best, bestDist = w, d
+			}
+		}
+		if best != "" {
+			terms[i] = best
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,210 @@
+package fuzzy
+
+import (
+	"math"
+	"regexp"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Beyoncé", "beyonce"},
+		{"  Sigur   Rós ", "sigur ros"},
+		{"AC/DC", "ac dc"},
+		{"Motörhead!", "motorhead"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Fold(tt.in); got != tt.want {
+			t.Errorf("Fold(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"metallica", "metallica", 0},
+		{"kitten", "sitting", 3},
+		{"metallica", "metalica", 1},
+		{"beyonce", "beyocne", 1}, // transposition
+		{"ca", "abc", 3},          // no edits inside a transposed pair
+		{"café", "cafe", 1},       // runes, not bytes
+	}
+	for _, tt := range tests {
+		if got := EditDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("EditDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMaxTypos(t *testing.T) {
+	tests := []struct {
+		term string
+		want int
+	}{
+		{"abc", 0},
+		{"abcd", 1},
+		{"abcdefg", 1},
+		{"abcdefgh", 2},
+		{"éèêë", 1},
+	}
+	for _, tt := range tests {
+		if got := MaxTypos(tt.term); got != tt.want {
+			t.Errorf("MaxTypos(%q) = %d, want %d", tt.term, got, tt.want)
+		}
+	}
+}
+
+func TestGramSize(t *testing.T) {
+	tests := []struct{ length, typos, want int }{
+		{4, 1, 2},
+		{6, 1, 2},
+		{7, 1, 3},
+		{8, 2, 2},
+		{10, 2, 2},
+		{11, 2, 3},
+	}
+	for _, tt := range tests {
+		if got := gramSize(tt.length, tt.typos); got != tt.want {
+			t.Errorf("gramSize(%d, %d) = %d, want %d", tt.length, tt.typos, got, tt.want)
+		}
+	}
+}
+
+// filterMatches reports whether Filter for term lets text through, using
+// Go's regexp in place of the database's.
+func filterMatches(t *testing.T, term, text string) bool {
+	t.Helper()
+	cond := Filter("name", term)["name"].(bson.M)
+	re, err := regexp.Compile("(?i)" + cond["$regex"].(string))
+	if err != nil {
+		t.Fatalf("Filter(%q) built a bad regex: %v", term, err)
+	}
+	return re.MatchString(text)
+}
+
+// singleEdits lists every deletion, insertion, substitution and adjacent
+// transposition of s, using x, which s must not contain, as the new rune.
+func singleEdits(s string) []string {
+	r := []rune(s)
+	var out []string
+	for i := range len(r) + 1 {
+		out = append(out, string(r[:i])+"x"+string(r[i:]))
+		if i == len(r) {
+			break
+		}
+		out = append(out, string(r[:i])+string(r[i+1:]), string(r[:i])+"x"+string(r[i+1:]))
+		if i+1 < len(r) {
+			out = append(out, string(r[:i])+string(r[i+1])+string(r[i])+string(r[i+2:]))
+		}
+	}
+	return out
+}
+
+// Whatever typos within MaxTypos a term carries, the prefilter must still
+// find the text it was meant to spell.
+func TestFilterSurvivesTypos(t *testing.T) {
+	const letters = "abcdefghijklmnop"
+	for n := 5; n <= len(letters); n++ {
+		word := letters[:n]
+		for _, once := range singleEdits(word) {
+			if !filterMatches(t, once, word) {
+				t.Errorf("%q with one typo as %q is filtered out", word, once)
+			}
+			if MaxTypos(word) < 2 {
+				continue
+			}
+			for _, twice := range singleEdits(once) {
+				if MaxTypos(twice) == 2 && !filterMatches(t, twice, word) {
+					t.Errorf("%q with two typos as %q is filtered out", word, twice)
+				}
+			}
+		}
+	}
+}
+
+func TestFilterFoldsDiacritics(t *testing.T) {
+	tests := []struct {
+		term, text string
+		want       bool
+	}{
+		{"Beyonce", "Beyoncé", true},
+		{"beyoncé", "BEYONCE", true},
+		{"Beyonse", "Beyoncé", true},
+		{"ros", "Sigur Rós", true}, // too short for typos: matched whole
+		{"rus", "Sigur Rós", false},
+		{"ac/dc", "AC/DC", true},
+		{"acdc", "AC/DC", true},
+		{"!!", "Hey!! Jude", true}, // nothing left to fold
+	}
+	for _, tt := range tests {
+		if got := filterMatches(t, tt.term, tt.text); got != tt.want {
+			t.Errorf("Filter(%q) matches %q = %v, want %v", tt.term, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTermScore(t *testing.T) {
+	tests := []struct {
+		term, text string
+		want       float64
+	}{
+		{"beyonce", "Beyoncé", 1},
+		{"drive", "Night Drive", 1},
+		{"beyo", "Beyoncé", 0.9},
+		{"beyocne", "Beyoncé Knowles", 0.8 * (1 - 1.0/7)},
+		{"metalica", "Metallica", 0.8 * (1 - 1.0/8)},
+		{"beethovn", "Beethovensonaten", 0.8 * (1 - 1.0/8)}, // misspelt start of a longer word
+		{"abd", "abc", 0},                                   // too short for typos
+		{"zzzzz", "abcde", 0},
+	}
+	for _, tt := range tests {
+		if got := TermScore(tt.term, tt.text); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("TermScore(%q, %q) = %g, want %g", tt.term, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		query, text string
+		want        float64
+	}{
+		{"night drive", "Night Drive", 1},
+		{"night xyzzy", "Night Drive", 0.5},
+		{"", "Night Drive", 0},
+	}
+	for _, tt := range tests {
+		if got := Score(tt.query, tt.text); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Score(%q, %q) = %g, want %g", tt.query, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDidYouMean(t *testing.T) {
+	tests := []struct {
+		query      string
+		vocabulary []string
+		want       string
+	}{
+		{"beyonse", []string{"Beyoncé"}, "beyonce"},
+		{"metalica live", []string{"Metallica", "Live at Wembley"}, "metallica live"},
+		{"night drive", []string{"Night Drive"}, ""},
+		{"bart", []string{"bort", "bert"}, "bert"}, // ties go alphabetically
+		{"abd", []string{"abc"}, ""},               // too short for typos
+		{"zzzzz", []string{"abcde"}, ""},
+	}
+	for _, tt := range tests {
+		if got := DidYouMean(tt.query, tt.vocabulary); got != tt.want {
+			t.Errorf("DidYouMean(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
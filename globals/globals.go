@@ -2,6 +2,10 @@ package globals
 
 import (
 	"context"
+	"crypto/rand"
+	"log"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -15,6 +19,29 @@ var (
 	JwtSecret = []byte("your_secret_key") // Replace with a secure secret key
 )
 
+var (
+	streamKey     []byte
+	streamKeyOnce sync.Once
+)
+
+// StreamSigningKey returns the key that signs expiring audio stream URLs,
+// read from STREAM_SIGNING_KEY on first use. It is deliberately separate
+// from JwtSecret so that leaking one key cannot forge the other's tokens.
+// Without the variable a random key is generated, which invalidates issued
+// URLs on restart and is not shared between instances.
+func StreamSigningKey() []byte {
+	streamKeyOnce.Do(func() {
+		if v := os.Getenv("STREAM_SIGNING_KEY"); v != "" {
+			streamKey = []byte(v)
+			return
+		}
+		log.Println("STREAM_SIGNING_KEY not set; using a random per-process key")
+		streamKey = make([]byte, 32)
+		rand.Read(streamKey)
+	})
+	return streamKey
+}
+
 // Context keys
 type ContextKey string
 
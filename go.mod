@@ -11,6 +11,7 @@ require (
 	github.com/redis/go-redis/v9 v9.12.1
 	github.com/rs/cors v1.11.1
 	go.mongodb.org/mongo-driver v1.17.4
+	golang.org/x/text v0.28.0
 	golang.org/x/time v0.12.0
 )
 
@@ -26,5 +27,4 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/text v0.28.0 // indirect
 )
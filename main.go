@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"naevis/middleware"
+	"naevis/musicon"
 	"naevis/ratelim"
 	"naevis/routes"
 
@@ -69,6 +70,20 @@ func main() {
 	// Initialize rate limiter
 	rateLimiter := ratelim.NewRateLimiter(1, 12, 10*time.Minute, 10000)
 
+	// Background jobs: trash purge, chart snapshots, the suggest index, HLS
+	// packaging, abandoned upload cleanup and the legacy likes import
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	indexCtx, cancelIndex := context.WithTimeout(jobsCtx, 30*time.Second)
+	musicon.EnsureLikeIndexes(indexCtx)
+	cancelIndex()
+	musicon.StartPlaylistPurger(jobsCtx)
+	musicon.StartChartBuilder(jobsCtx)
+	musicon.StartSuggestIndexer(jobsCtx)
+	musicon.StartHLSPackager(jobsCtx)
+	musicon.StartUploadJanitor(jobsCtx)
+	musicon.StartLegacyLikesImport(jobsCtx)
+
 	// Build router
 	router := setupRouter(rateLimiter)
 	// routes.AddStaticRoutes(router)
@@ -80,7 +95,7 @@ func main() {
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   allowedOrigins,
 		AllowedMethods:   []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization", "Idempotency-Key", "X-Requested-With"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "Idempotency-Key", "X-Requested-With", "X-Chunk-Sha256"},
 		AllowCredentials: true,
 	}).Handler(innerHandler)
 
@@ -0,0 +1,802 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Audio formats recognised by SniffAudioFormat. Each doubles as the file
+// extension uploads are stored under.
+const (
+	AudioMP3  = "mp3"
+	AudioFLAC = "flac"
+	AudioOGG  = "ogg"
+	AudioWAV  = "wav"
+	AudioM4A  = "m4a"
+)
+
+const (
+	// AudioSniffLen is how many leading bytes SniffAudioFormat looks at.
+	AudioSniffLen = 12
+	// maxTagBytes bounds how much of a file is read for any one tag block,
+	// so a corrupt size field cannot make us load the whole file.
+	maxTagBytes = 1 << 20
+	// oggScanBytes is how much of each end of an Ogg file is scanned for
+	// headers and the final granule position.
+	oggScanBytes = 64 << 10
+	maxTagFrames = 1000
+)
+
+// ErrUnknownAudio is returned for files that are none of the supported
+// formats.
+var ErrUnknownAudio = errors.New("unrecognised audio format")
+
+// m4aBrands are the ftyp major brands accepted as M4A audio.
+var m4aBrands = map[string]bool{"M4A ": true, "M4B ": true, "mp41": true, "mp42": true, "isom": true}
+
+// SniffAudioFormat identifies an audio file from its leading bytes,
+// ignoring whatever extension or content type the client claimed. It
+// returns "" for anything unrecognised. A match is only a candidate:
+// ReadAudioMeta confirms the file really holds audio.
+func SniffAudioFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return AudioMP3
+	case isMP3Frame(head):
+		// Bare MPEG frame with no tag in front
+		return AudioMP3
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return AudioFLAC
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return AudioOGG
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return AudioWAV
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && m4aBrands[string(head[8:12])]:
+		return AudioM4A
+	}
+	return ""
+}
+
+// AudioMeta is what could be read from an audio file's headers and tags.
+// Fields the file does not carry are left empty.
+type AudioMeta struct {
+	Format   string
+	Duration time.Duration
+	Title    string
+	Artist   string
+	Album    string
+	Genre    string
+	Language string
+}
+
+// ReadAudioMeta reads the duration and tags of an audio file of the given
+// sniffed format. Files without a valid audio stream header, such as
+// anything after an ID3 tag or MP4 video, fail with ErrUnknownAudio.
+// Missing or damaged tags are not an error.
+func ReadAudioMeta(r io.ReaderAt, size int64, format string) (AudioMeta, error) {
+	meta := AudioMeta{Format: format}
+	var err error
+	switch format {
+	case AudioMP3:
+		err = readMP3Meta(r, size, &meta)
+	case AudioFLAC:
+		err = readFLACMeta(r, size, &meta)
+	case AudioOGG:
+		err = readOggMeta(r, size, &meta)
+	case AudioWAV:
+		err = readWAVMeta(r, size, &meta)
+	case AudioM4A:
+		err = readM4AMeta(r, size, &meta)
+	default:
+		return meta, ErrUnknownAudio
+	}
+	return meta, err
+}
+
+// ratioDuration converts a count of units at a rate per second, such as
+// samples at a sample rate, to a duration without overflowing.
+func ratioDuration(count, perSecond int64) time.Duration {
+	if perSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(count) / float64(perSecond) * float64(time.Second))
+}
+
+// readAt reads up to n bytes at off, fewer if the file ends first.
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	got, err := r.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:got], err
+}
+
+// --------------------------- MP3 ---------------------------
+
+var (
+	mp3BitratesV1 = [3][15]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // Layer I
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // Layer II
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // Layer III
+	}
+	mp3BitratesV2 = [3][15]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// mp3Frame is a decoded MPEG audio frame header.
+type mp3Frame struct {
+	mpeg1      bool
+	mono       bool
+	bitrate    int // kbit/s
+	sampleRate int
+	samples    int // per frame
+	size       int // bytes, header included
+}
+
+func isMP3Frame(h []byte) bool {
+	_, ok := parseMP3Frame(h)
+	return ok
+}
+
+func parseMP3Frame(h []byte) (mp3Frame, bool) {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	version := (h[1] >> 3) & 3 // 0 MPEG2.5, 2 MPEG2, 3 MPEG1
+	layer := 4 - int((h[1]>>1)&3)
+	rateIdx := int(h[2] >> 4)
+	srIdx := int((h[2] >> 2) & 3)
+	if version == 1 || layer == 4 || rateIdx == 0 || rateIdx == 15 || srIdx == 3 {
+		return mp3Frame{}, false
+	}
+
+	f := mp3Frame{mpeg1: version == 3, mono: h[3]>>6 == 3}
+	f.sampleRate = mp3SampleRates[srIdx]
+	switch version {
+	case 2:
+		f.sampleRate /= 2
+	case 0:
+		f.sampleRate /= 4
+	}
+	if f.mpeg1 {
+		f.bitrate = mp3BitratesV1[layer-1][rateIdx]
+	} else {
+		f.bitrate = mp3BitratesV2[layer-1][rateIdx]
+	}
+	switch {
+	case layer == 1:
+		f.samples = 384
+	case layer == 3 && !f.mpeg1:
+		f.samples = 576
+	default:
+		f.samples = 1152
+	}
+	padding := int(h[2]>>1) & 1
+	if layer == 1 {
+		f.size = (12*f.bitrate*1000/f.sampleRate + padding) * 4
+	} else {
+		f.size = f.samples/8*f.bitrate*1000/f.sampleRate + padding
+	}
+	return f, true
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+func readMP3Meta(r io.ReaderAt, size int64, meta *AudioMeta) error {
+	var audioStart int64
+	head, err := readAt(r, 0, 10)
+	if err != nil {
+		return err
+	}
+	if len(head) == 10 && string(head[:3]) == "ID3" {
+		tagSize := int64(syncsafe(head[6:10])) + 10
+		if head[5]&0x10 != 0 {
+			tagSize += 10 // footer
+		}
+		tag, err := readAt(r, 10, int(min(tagSize-10, maxTagBytes)))
+		if err != nil {
+			return err
+		}
+		parseID3v2(tag, head[3], head[5], meta)
+		audioStart = tagSize
+	}
+	audioEnd := size
+	if size >= 128 {
+		if v1, err := readAt(r, size-128, 128); err == nil && string(v1[:3]) == "TAG" {
+			parseID3v1(v1, meta)
+			audioEnd -= 128
+		}
+	}
+
+	// Find the first frame, skipping any padding or junk after the tag. A
+	// frame only counts if the next one follows right after it, or it ends
+	// the file, since a stray sync pattern is easily found in any data.
+	window, err := readAt(r, audioStart, 64<<10)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+4 <= len(window); i++ {
+		frame, ok := parseMP3Frame(window[i:])
+		if !ok {
+			continue
+		}
+		next := i + frame.size
+		if audioStart+int64(next) != audioEnd && (next+4 > len(window) || !isMP3Frame(window[next:])) {
+			continue
+		}
+		if d := mp3VBRDuration(window[i:], frame); d > 0 {
+			meta.Duration = d
+		} else if frame.bitrate > 0 {
+			// Constant bitrate: the byte count gives the duration
+			bytesLen := audioEnd - audioStart - int64(i)
+			meta.Duration = ratioDuration(bytesLen*8, int64(frame.bitrate)*1000)
+		}
+		return nil
+	}
+	return ErrUnknownAudio
+}
+
+// mp3VBRDuration reads the frame count from a Xing/Info or VBRI header in
+// the first frame, as written by VBR encoders. It returns 0 if there is
+// none.
+func mp3VBRDuration(b []byte, f mp3Frame) time.Duration {
+	side := 17
+	switch {
+	case f.mpeg1 && !f.mono:
+		side = 32
+	case !f.mpeg1 && f.mono:
+		side = 9
+	}
+	frames := 0
+	if x := 4 + side; len(b) >= x+12 && (string(b[x:x+4]) == "Xing" || string(b[x:x+4]) == "Info") {
+		if binary.BigEndian.Uint32(b[x+4:x+8])&1 != 0 {
+			frames = int(binary.BigEndian.Uint32(b[x+8 : x+12]))
+		}
+	} else if v := 4 + 32; len(b) >= v+18 && string(b[v:v+4]) == "VBRI" {
+		frames = int(binary.BigEndian.Uint32(b[v+14 : v+18]))
+	}
+	return ratioDuration(int64(frames)*int64(f.samples), int64(f.sampleRate))
+}
+
+// parseID3v2 reads text frames from an ID3v2.2, 2.3 or 2.4 tag body.
+func parseID3v2(tag []byte, version, flags byte, meta *AudioMeta) {
+	idLen, hdrLen := 4, 10
+	ids := map[string]*string{
+		"TIT2": &meta.Title, "TPE1": &meta.Artist, "TALB": &meta.Album,
+		"TCON": &meta.Genre, "TLAN": &meta.Language,
+	}
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+		ids = map[string]*string{
+			"TT2": &meta.Title, "TP1": &meta.Artist, "TAL": &meta.Album, "TCO": &meta.Genre,
+		}
+	}
+
+	pos := 0
+	if flags&0x40 != 0 && version >= 3 && len(tag) >= 4 {
+		// Extended header: v2.4 counts its own size field, v2.3 does not
+		if version == 4 {
+			pos = syncsafe(tag[:4])
+		} else {
+			pos = int(binary.BigEndian.Uint32(tag[:4])) + 4
+		}
+	}
+
+	var lengthMS string
+	for n := 0; n < maxTagFrames && pos+hdrLen <= len(tag) && tag[pos] != 0; n++ {
+		id := string(tag[pos : pos+idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[pos+3])<<16 | int(tag[pos+4])<<8 | int(tag[pos+5])
+		case 4:
+			size = syncsafe(tag[pos+4 : pos+8])
+		default:
+			size = int(binary.BigEndian.Uint32(tag[pos+4 : pos+8]))
+		}
+		pos += hdrLen
+		if size <= 0 || pos+size > len(tag) {
+			break
+		}
+		body := tag[pos : pos+size]
+		pos += size
+
+		if dst, ok := ids[id]; ok && *dst == "" {
+			*dst = decodeID3Text(body)
+		} else if id == "TLEN" || id == "TLE" {
+			lengthMS = decodeID3Text(body)
+		}
+	}
+
+	meta.Genre = id3Genre(meta.Genre)
+	if ms, err := strconv.Atoi(lengthMS); err == nil && ms > 0 && meta.Duration == 0 {
+		meta.Duration = time.Duration(ms) * time.Millisecond
+	}
+}
+
+// decodeID3Text decodes a text frame body, returning its first value.
+func decodeID3Text(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	enc, data := b[0], b[1:]
+	var s string
+	switch enc {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := enc == 2
+		if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+			data = data[2:]
+		} else if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+			bigEndian, data = true, data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			var u uint16
+			if bigEndian {
+				u = binary.BigEndian.Uint16(data[i:])
+			} else {
+				u = binary.LittleEndian.Uint16(data[i:])
+			}
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		s = string(utf16.Decode(units))
+	case 3: // UTF-8
+		s, _, _ = strings.Cut(string(data), "\x00")
+	default: // ISO-8859-1
+		data, _, _ = bytes.Cut(data, []byte{0})
+		s = latin1(data)
+	}
+	return strings.TrimSpace(s)
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// parseID3v1 fills fields still empty from a trailing 128-byte ID3v1 tag.
+func parseID3v1(b []byte, meta *AudioMeta) {
+	field := func(from, to int) string {
+		v, _, _ := bytes.Cut(b[from:to], []byte{0})
+		return strings.TrimSpace(latin1(v))
+	}
+	if meta.Title == "" {
+		meta.Title = field(3, 33)
+	}
+	if meta.Artist == "" {
+		meta.Artist = field(33, 63)
+	}
+	if meta.Album == "" {
+		meta.Album = field(63, 93)
+	}
+	if meta.Genre == "" && int(b[127]) < len(id3v1Genres) {
+		meta.Genre = id3v1Genres[b[127]]
+	}
+}
+
+// id3v1Genres are the standard ID3v1 genre numbers, which ID3v2 genre
+// frames may also refer to.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// id3Genre resolves ID3v2 genre references such as "(17)" or "17" to
+// their names; free-text genres are returned as is.
+func id3Genre(g string) string {
+	ref := g
+	if strings.HasPrefix(g, "(") {
+		num, rest, ok := strings.Cut(g[1:], ")")
+		if !ok {
+			return g
+		}
+		if rest != "" {
+			return strings.TrimSpace(rest)
+		}
+		ref = num
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return g
+}
+
+// --------------------------- FLAC and Vorbis ---------------------------
+
+// readFLACMeta requires the STREAMINFO block, which always comes first.
+func readFLACMeta(r io.ReaderAt, size int64, meta *AudioMeta) error {
+	pos := int64(4) // after "fLaC"
+	streamInfo := false
+	for n := 0; n < maxTagFrames && pos+4 <= size; n++ {
+		hdr, err := readAt(r, pos, 4)
+		if err != nil {
+			return err
+		}
+		if len(hdr) < 4 {
+			break
+		}
+		last, kind := hdr[0]&0x80 != 0, hdr[0]&0x7F
+		length := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		pos += 4
+
+		switch kind {
+		case 0: // STREAMINFO
+			b, err := readAt(r, pos, 18)
+			if err != nil {
+				return err
+			}
+			rate := int64(0)
+			if len(b) == 18 {
+				rate = int64(b[10])<<12 | int64(b[11])<<4 | int64(b[12])>>4
+			}
+			if n != 0 || length != 34 || rate == 0 {
+				return ErrUnknownAudio
+			}
+			streamInfo = true
+			total := int64(b[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(b[14:18]))
+			meta.Duration = ratioDuration(total, rate)
+		case 4: // VORBIS_COMMENT
+			b, err := readAt(r, pos, int(min(length, maxTagBytes)))
+			if err != nil {
+				return err
+			}
+			parseVorbisComments(b, meta)
+		}
+		pos += length
+		if last {
+			break
+		}
+	}
+	if !streamInfo {
+		return ErrUnknownAudio
+	}
+	return nil
+}
+
+// parseVorbisComments reads a Vorbis comment block, as used by FLAC, Ogg
+// Vorbis and Opus: a vendor string and then KEY=value pairs, all with
+// little-endian length prefixes.
+func parseVorbisComments(b []byte, meta *AudioMeta) {
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n < 0 || n > len(b)-4 {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+	if _, ok := next(); !ok { // vendor
+		return
+	}
+	if len(b) < 4 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+
+	fields := map[string]*string{
+		"TITLE": &meta.Title, "ARTIST": &meta.Artist, "ALBUM": &meta.Album,
+		"GENRE": &meta.Genre, "LANGUAGE": &meta.Language,
+	}
+	for i := 0; i < count && i < maxTagFrames; i++ {
+		c, ok := next()
+		if !ok {
+			return
+		}
+		key, value, ok := strings.Cut(string(c), "=")
+		if !ok {
+			continue
+		}
+		if dst, ok := fields[strings.ToUpper(key)]; ok && *dst == "" {
+			*dst = strings.TrimSpace(value)
+		}
+	}
+}
+
+func readOggMeta(r io.ReaderAt, size int64, meta *AudioMeta) error {
+	head, err := readAt(r, 0, oggScanBytes)
+	if err != nil {
+		return err
+	}
+
+	// Opus granule positions always count 48 kHz samples, after a pre-skip
+	rate, preSkip := int64(0), int64(0)
+	if i := bytes.Index(head, []byte("\x01vorbis")); i >= 0 && i+16 <= len(head) {
+		rate = int64(binary.LittleEndian.Uint32(head[i+12:]))
+	} else if i := bytes.Index(head, []byte("OpusHead")); i >= 0 && i+12 <= len(head) {
+		rate, preSkip = 48000, int64(binary.LittleEndian.Uint16(head[i+10:]))
+	}
+	if rate == 0 {
+		// Neither a Vorbis nor an Opus stream
+		return ErrUnknownAudio
+	}
+	if i := bytes.Index(head, []byte("\x03vorbis")); i >= 0 {
+		parseVorbisComments(head[i+7:], meta)
+	} else if i := bytes.Index(head, []byte("OpusTags")); i >= 0 {
+		parseVorbisComments(head[i+8:], meta)
+	}
+
+	// The last page's granule position is the total sample count
+	start := max(size-oggScanBytes, 0)
+	tail, err := readAt(r, start, int(size-start))
+	if err != nil {
+		return err
+	}
+	if i := bytes.LastIndex(tail, []byte("OggS")); i >= 0 && i+14 <= len(tail) {
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6:]))
+		if granule > preSkip {
+			meta.Duration = ratioDuration(granule-preSkip, rate)
+		}
+	}
+	return nil
+}
+
+// --------------------------- WAV ---------------------------
+
+// readWAVMeta requires a format chunk and a data chunk.
+func readWAVMeta(r io.ReaderAt, size int64, meta *AudioMeta) error {
+	var byteRate, dataSize int64
+	hasData := false
+	pos := int64(12) // after "RIFF", size, "WAVE"
+	for n := 0; n < maxTagFrames && pos+8 <= size; n++ {
+		hdr, err := readAt(r, pos, 8)
+		if err != nil {
+			return err
+		}
+		if len(hdr) < 8 {
+			break
+		}
+		id, length := string(hdr[:4]), int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		pos += 8
+
+		switch id {
+		case "fmt ":
+			b, err := readAt(r, pos, 16)
+			if err != nil {
+				return err
+			}
+			if len(b) == 16 {
+				byteRate = int64(binary.LittleEndian.Uint32(b[8:12]))
+			}
+		case "data":
+			dataSize, hasData = min(length, size-pos), true
+		case "LIST":
+			b, err := readAt(r, pos, int(min(length, maxTagBytes)))
+			if err != nil {
+				return err
+			}
+			if len(b) >= 4 && string(b[:4]) == "INFO" {
+				parseRIFFInfo(b[4:], meta)
+			}
+		}
+		pos += length + length%2 // chunks are word-aligned
+	}
+	if byteRate == 0 || !hasData {
+		return ErrUnknownAudio
+	}
+	meta.Duration = ratioDuration(dataSize, byteRate)
+	return nil
+}
+
+// parseRIFFInfo reads the title, artist and genre from a LIST INFO chunk.
+func parseRIFFInfo(b []byte, meta *AudioMeta) {
+	fields := map[string]*string{"INAM": &meta.Title, "IART": &meta.Artist, "IPRD": &meta.Album, "IGNR": &meta.Genre}
+	for len(b) >= 8 {
+		id, n := string(b[:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+		if n < 0 || n > len(b)-8 {
+			return
+		}
+		if dst, ok := fields[id]; ok && *dst == "" {
+			v, _, _ := bytes.Cut(b[8:8+n], []byte{0})
+			*dst = strings.TrimSpace(string(v))
+		}
+		b = b[min(8+n+n%2, len(b)):]
+	}
+}
+
+// --------------------------- M4A ---------------------------
+
+// mp4Box is a box (atom) of an MP4 file, located by its body.
+type mp4Box struct {
+	kind       string
+	start, end int64
+}
+
+// mp4Children lists the boxes between start and end.
+func mp4Children(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	pos := start
+	for n := 0; n < maxTagFrames && pos+8 <= end; n++ {
+		hdr, err := readAt(r, pos, 16)
+		if err != nil {
+			return nil, err
+		}
+		if len(hdr) < 8 {
+			break
+		}
+		size, body := int64(binary.BigEndian.Uint32(hdr[:4])), pos+8
+		switch size {
+		case 0: // extends to the end of its parent
+			size = end - pos
+		case 1: // 64-bit size follows the type
+			if len(hdr) < 16 {
+				return boxes, nil
+			}
+			size, body = int64(binary.BigEndian.Uint64(hdr[8:16])), pos+16
+		}
+		if size < body-pos || pos+size > end {
+			break
+		}
+		boxes = append(boxes, mp4Box{kind: string(hdr[4:8]), start: body, end: pos + size})
+		pos += size
+	}
+	return boxes, nil
+}
+
+// mp4Find descends through the path of box types, returning the last.
+func mp4Find(r io.ReaderAt, start, end int64, path ...string) (mp4Box, bool, error) {
+	box := mp4Box{start: start, end: end}
+	for _, kind := range path {
+		children, err := mp4Children(r, box.start, box.end)
+		if err != nil {
+			return mp4Box{}, false, err
+		}
+		found := false
+		for _, c := range children {
+			if c.kind == kind {
+				box, found = c, true
+				break
+			}
+		}
+		if !found {
+			return mp4Box{}, false, nil
+		}
+		if kind == "meta" {
+			box.start += 4 // meta is a full box with version and flags
+		}
+	}
+	return box, true, nil
+}
+
+// mp4Handlers lists the handler type of every track, such as "soun" for
+// audio and "vide" for video.
+func mp4Handlers(r io.ReaderAt, moov mp4Box) ([]string, error) {
+	children, err := mp4Children(r, moov.start, moov.end)
+	if err != nil {
+		return nil, err
+	}
+	var handlers []string
+	for _, trak := range children {
+		if trak.kind != "trak" {
+			continue
+		}
+		hdlr, ok, err := mp4Find(r, trak.start, trak.end, "mdia", "hdlr")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		// Version and flags, then a reserved field, then the type
+		b, err := readAt(r, hdlr.start+8, 4)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, string(b))
+	}
+	return handlers, nil
+}
+
+// readM4AMeta requires at least one sound track and no video track, since
+// the accepted brands are shared with MP4 video.
+func readM4AMeta(r io.ReaderAt, size int64, meta *AudioMeta) error {
+	moov, ok, err := mp4Find(r, 0, size, "moov")
+	if err != nil || !ok {
+		if err == nil {
+			err = ErrUnknownAudio
+		}
+		return err
+	}
+	handlers, err := mp4Handlers(r, moov)
+	if err != nil {
+		return err
+	}
+	sound := false
+	for _, h := range handlers {
+		switch h {
+		case "soun":
+			sound = true
+		case "vide":
+			return ErrUnknownAudio
+		}
+	}
+	if !sound {
+		return ErrUnknownAudio
+	}
+
+	mvhd, ok, err := mp4Find(r, moov.start, moov.end, "mvhd")
+	if err != nil {
+		return err
+	}
+	if ok {
+		b, err := readAt(r, mvhd.start, 32)
+		if err != nil {
+			return err
+		}
+		var timescale, duration int64
+		if len(b) >= 20 && b[0] == 0 {
+			timescale = int64(binary.BigEndian.Uint32(b[12:16]))
+			duration = int64(binary.BigEndian.Uint32(b[16:20]))
+		} else if len(b) >= 32 && b[0] == 1 {
+			timescale = int64(binary.BigEndian.Uint32(b[20:24]))
+			duration = int64(binary.BigEndian.Uint64(b[24:32]))
+		}
+		meta.Duration = ratioDuration(duration, timescale)
+	}
+
+	ilst, ok, err := mp4Find(r, moov.start, moov.end, "udta", "meta", "ilst")
+	if err != nil || !ok {
+		return err
+	}
+	items, err := mp4Children(r, ilst.start, min(ilst.end, ilst.start+maxTagBytes))
+	if err != nil {
+		return err
+	}
+	fields := map[string]*string{
+		"\xa9nam": &meta.Title, "\xa9ART": &meta.Artist, "\xa9alb": &meta.Album, "\xa9gen": &meta.Genre,
+	}
+	for _, item := range items {
+		data, ok, err := mp4Find(r, item.start, item.end, "data")
+		if err != nil {
+			return err
+		}
+		// data holds a 4-byte type indicator and 4-byte locale
+		if !ok || data.end-data.start < 8 {
+			continue
+		}
+		value, err := readAt(r, data.start+8, int(min(data.end-data.start-8, 4096)))
+		if err != nil {
+			return err
+		}
+		if dst, ok := fields[item.kind]; ok && *dst == "" {
+			*dst = strings.TrimSpace(string(value))
+		} else if item.kind == "gnre" && meta.Genre == "" && len(value) >= 2 {
+			// Numeric genre, one-based ID3v1 index
+			if n := int(binary.BigEndian.Uint16(value)) - 1; n >= 0 && n < len(id3v1Genres) {
+				meta.Genre = id3v1Genres[n]
+			}
+		}
+	}
+	return nil
+}
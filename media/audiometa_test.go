@@ -0,0 +1,257 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// The fixtures below are minimal files built byte by byte: just the
+// headers and tags the parsers read, with silence standing in for audio.
+
+func be32(n int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(n)) }
+func le32(n int) []byte { return binary.LittleEndian.AppendUint32(nil, uint32(n)) }
+
+func join(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+// id3Frame is an ID3v2.3 text frame in ISO-8859-1.
+func id3Frame(id, text string) []byte {
+	body := append([]byte{0}, text...)
+	return join([]byte(id), be32(len(body)), []byte{0, 0}, body)
+}
+
+// id3Tag wraps frames in an ID3v2.3 header.
+func id3Tag(frames ...[]byte) []byte {
+	tag := join(frames...)
+	size := len(tag)
+	return join([]byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}, tag)
+}
+
+// mp3Frames is n silent 384-byte frames of 128 kbit/s, 48 kHz MPEG-1 Layer
+// III, 125 of which make three seconds.
+func mp3Frames(n int) []byte {
+	frame := make([]byte, 384)
+	copy(frame, []byte{0xFF, 0xFB, 0x94, 0x00})
+	return bytes.Repeat(frame, n)
+}
+
+// mp3Fixture is an ID3v2.3 tag followed by three seconds of CBR audio.
+func mp3Fixture() []byte {
+	return join(id3Tag(id3Frame("TIT2", "Night Drive"), id3Frame("TPE1", "Naevis"), id3Frame("TCON", "(17)")), mp3Frames(125))
+}
+
+// vorbisComments is a Vorbis comment block holding the given KEY=value
+// pairs.
+func vorbisComments(pairs ...string) []byte {
+	b := join(le32(6), []byte("naevis"), le32(len(pairs)))
+	for _, p := range pairs {
+		b = join(b, le32(len(p)), []byte(p))
+	}
+	return b
+}
+
+// flacFixture is three seconds at 44.1 kHz with Vorbis comments.
+func flacFixture() []byte {
+	info := make([]byte, 34)
+	rate, total := 44100, 3*44100
+	info[10], info[11], info[12] = byte(rate>>12), byte(rate>>4), byte(rate<<4)
+	copy(info[14:], be32(total))
+	comments := vorbisComments("TITLE=Night Drive", "artist=Naevis", "GENRE=Synthwave", "LANGUAGE=en")
+	n := len(comments)
+	return join([]byte("fLaC"),
+		[]byte{0, 0, 0, 34}, info,
+		[]byte{0x84, byte(n >> 16), byte(n >> 8), byte(n)}, comments)
+}
+
+// oggPage is the start of an Ogg page header carrying granule.
+func oggPage(granule int) []byte {
+	return join([]byte("OggS"), []byte{0, 0}, binary.LittleEndian.AppendUint64(nil, uint64(granule)), make([]byte, 12))
+}
+
+// oggVorbisFixture is two seconds of 44.1 kHz Vorbis.
+func oggVorbisFixture() []byte {
+	ident := join([]byte("\x01vorbis"), le32(0), []byte{2}, le32(44100), make([]byte, 16))
+	comments := join([]byte("\x03vorbis"), vorbisComments("TITLE=Night Drive", "GENRE=Synthwave"))
+	return join(oggPage(0), ident, oggPage(0), comments, oggPage(2*44100))
+}
+
+// oggOpusFixture is two seconds of Opus after a 312-sample pre-skip.
+func oggOpusFixture() []byte {
+	head := join([]byte("OpusHead"), []byte{1, 2, 0x38, 0x01}, le32(48000), make([]byte, 3))
+	tags := join([]byte("OpusTags"), vorbisComments("TITLE=Night Drive", "ARTIST=Naevis"))
+	return join(oggPage(0), head, oggPage(0), tags, oggPage(2*48000+312))
+}
+
+// wavFixture is 2.5 seconds at 1000 bytes per second with a LIST INFO
+// chunk, whose odd-sized title exercises chunk padding.
+func wavFixture() []byte {
+	fmtChunk := join([]byte{1, 0, 1, 0}, le32(1000), le32(1000), []byte{1, 0, 8, 0})
+	info := join([]byte("INFO"),
+		[]byte("INAM"), le32(12), []byte("Night Drive\x00"),
+		[]byte("IART"), le32(7), []byte("Naevis\x00"), []byte{0},
+		[]byte("IGNR"), le32(10), []byte("Synthwave\x00"))
+	body := join([]byte("WAVE"),
+		[]byte("fmt "), le32(len(fmtChunk)), fmtChunk,
+		[]byte("LIST"), le32(len(info)), info,
+		[]byte("data"), le32(2500), make([]byte, 2500))
+	return join([]byte("RIFF"), le32(len(body)), body)
+}
+
+// mp4Atom is an MP4 box of the given type around its children.
+func mp4Atom(kind string, children ...[]byte) []byte {
+	body := join(children...)
+	return join(be32(8+len(body)), []byte(kind), body)
+}
+
+// mp4Track is a track whose handler is of the given type.
+func mp4Track(handler string) []byte {
+	hdlr := join(make([]byte, 8), []byte(handler), make([]byte, 13))
+	return mp4Atom("trak", mp4Atom("mdia", mp4Atom("hdlr", hdlr)))
+}
+
+// m4aFixture is four seconds at a 1000 Hz timescale with iTunes tags,
+// the genre given as a numeric ID3v1 reference.
+func m4aFixture() []byte {
+	mvhd := join([]byte{0, 0, 0, 0}, be32(0), be32(0), be32(1000), be32(4000), make([]byte, 80))
+	item := func(kind string, value []byte) []byte {
+		return mp4Atom(kind, mp4Atom("data", be32(1), be32(0), value))
+	}
+	ilst := mp4Atom("ilst",
+		item("\xa9nam", []byte("Night Drive")),
+		item("\xa9ART", []byte("Naevis")),
+		item("gnre", []byte{0, 18}))
+	meta := mp4Atom("meta", []byte{0, 0, 0, 0}, mp4Atom("hdlr", make([]byte, 25)), ilst)
+	return join(
+		mp4Atom("ftyp", []byte("M4A "), be32(0), []byte("M4A isom")),
+		mp4Atom("moov", mp4Atom("mvhd", mvhd), mp4Track("soun"), mp4Atom("udta", meta)),
+		mp4Atom("mdat", make([]byte, 64)))
+}
+
+var audioFixtures = []struct {
+	name   string
+	data   []byte
+	format string
+	want   AudioMeta
+}{
+	{"mp3", mp3Fixture(), AudioMP3, AudioMeta{Duration: 3 * time.Second, Title: "Night Drive", Artist: "Naevis", Genre: "Rock"}},
+	{"flac", flacFixture(), AudioFLAC, AudioMeta{Duration: 3 * time.Second, Title: "Night Drive", Artist: "Naevis", Genre: "Synthwave", Language: "en"}},
+	{"ogg vorbis", oggVorbisFixture(), AudioOGG, AudioMeta{Duration: 2 * time.Second, Title: "Night Drive", Genre: "Synthwave"}},
+	{"ogg opus", oggOpusFixture(), AudioOGG, AudioMeta{Duration: 2 * time.Second, Title: "Night Drive", Artist: "Naevis"}},
+	{"wav", wavFixture(), AudioWAV, AudioMeta{Duration: 2500 * time.Millisecond, Title: "Night Drive", Artist: "Naevis", Genre: "Synthwave"}},
+	{"m4a", m4aFixture(), AudioM4A, AudioMeta{Duration: 4 * time.Second, Title: "Night Drive", Artist: "Naevis", Genre: "Rock"}},
+}
+
+func TestSniffAudioFormat(t *testing.T) {
+	for _, tt := range audioFixtures {
+		if got := SniffAudioFormat(tt.data[:AudioSniffLen]); got != tt.format {
+			t.Errorf("%s: sniffed %q, want %q", tt.name, got, tt.format)
+		}
+	}
+
+	// A bare MPEG frame with no ID3 tag is still MP3
+	if got := SniffAudioFormat(mp3Frames(1)[:AudioSniffLen]); got != AudioMP3 {
+		t.Errorf("bare MPEG frame: sniffed %q, want %q", got, AudioMP3)
+	}
+
+	rejected := map[string][]byte{
+		"empty":          nil,
+		"png":            []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"),
+		"avi":            []byte("RIFF\x00\x00\x00\x00AVI "),
+		"mp4 video":      []byte("\x00\x00\x00\x18ftypqt  "),
+		"truncated riff": []byte("RIFF\x00\x00"),
+		"truncated ftyp": []byte("\x00\x00\x00\x18ftyp"),
+		"reserved layer": {0xFF, 0xE0},
+		"bad bitrate":    {0xFF, 0xFB, 0xF4, 0x00},
+	}
+	for name, head := range rejected {
+		if got := SniffAudioFormat(head); got != "" {
+			t.Errorf("%s: sniffed %q, want none", name, got)
+		}
+	}
+}
+
+func TestReadAudioMeta(t *testing.T) {
+	for _, tt := range audioFixtures {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadAudioMeta(bytes.NewReader(tt.data), int64(len(tt.data)), tt.format)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.want.Format = tt.format
+			if got != tt.want {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAudioMetaUnknownFormat(t *testing.T) {
+	if _, err := ReadAudioMeta(bytes.NewReader(nil), 0, "aiff"); !errors.Is(err, ErrUnknownAudio) {
+		t.Errorf("got error %v, want ErrUnknownAudio", err)
+	}
+}
+
+// Files that sniff as audio but hold no audio stream are rejected.
+func TestReadAudioMetaRejectsNonAudio(t *testing.T) {
+	junk := bytes.Repeat([]byte("not audio "), 100)
+	// A stray frame sync followed by anything but another frame
+	stray := join([]byte{0xFF, 0xFB, 0x94, 0x00}, junk)
+	video := join(
+		mp4Atom("ftyp", []byte("isom"), be32(0), []byte("isomavc1")),
+		mp4Atom("moov", mp4Atom("mvhd", make([]byte, 100)), mp4Track("vide"), mp4Track("soun")))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"junk after ID3", join(id3Tag(id3Frame("TIT2", "x")), junk), AudioMP3},
+		{"stray frame sync", stray, AudioMP3},
+		{"flac without streaminfo", join([]byte("fLaC"), []byte{0x84, 0, 0, 4}, le32(0)), AudioFLAC},
+		{"ogg without stream header", join(oggPage(0), junk), AudioOGG},
+		{"wav without data", join([]byte("RIFF"), le32(28), []byte("WAVEfmt "), le32(16), make([]byte, 16)), AudioWAV},
+		{"mp4 video", video, AudioM4A},
+		{"mp4 without tracks", mp4Atom("ftyp", []byte("M4A "), be32(0)), AudioM4A},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffAudioFormat(tt.data[:min(len(tt.data), AudioSniffLen)]); got != tt.format {
+				t.Fatalf("sniffed %q, want %q", got, tt.format)
+			}
+			_, err := ReadAudioMeta(bytes.NewReader(tt.data), int64(len(tt.data)), tt.format)
+			if !errors.Is(err, ErrUnknownAudio) {
+				t.Errorf("got error %v, want ErrUnknownAudio", err)
+			}
+		})
+	}
+}
+
+// A file cut off inside its stream header is not audio; cut off later, the
+// fields that could be read are returned and the rest left empty. Neither
+// is a read error.
+func TestReadAudioMetaTruncated(t *testing.T) {
+	for _, tt := range audioFixtures {
+		for n := range len(tt.data) {
+			data := tt.data[:n]
+			_, err := ReadAudioMeta(bytes.NewReader(data), int64(n), tt.format)
+			if err != nil && !errors.Is(err, ErrUnknownAudio) {
+				t.Fatalf("%s cut to %d bytes: %v", tt.name, n, err)
+			}
+		}
+	}
+
+	data := flacFixture()[:20]
+	if _, err := ReadAudioMeta(bytes.NewReader(data), int64(len(data)), AudioFLAC); !errors.Is(err, ErrUnknownAudio) {
+		t.Errorf("FLAC cut inside STREAMINFO: got error %v, want ErrUnknownAudio", err)
+	}
+
+	data = wavFixture()
+	data = data[:len(data)-1000]
+	got, err := ReadAudioMeta(bytes.NewReader(data), int64(len(data)), AudioWAV)
+	if err != nil || got.Duration != 1500*time.Millisecond || got.Title != "Night Drive" {
+		t.Errorf("WAV cut inside data: got %+v, %v; want the 1.5s received", got, err)
+	}
+}
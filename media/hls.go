@@ -0,0 +1,173 @@
+// Package media holds the audio processing that does not depend on
+// storage: HLS packaging and reading uploaded audio files. Keeping it free
+// of database access lets it be tested on its own.
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	HLSMasterPlaylist  = "master.m3u8"
+	HLSVariantPlaylist = "index.m3u8"
+	hlsSegmentSeconds  = 6
+	// hlsCodecs is AAC-LC, which every HLS client can decode.
+	hlsCodecs = "mp4a.40.2"
+)
+
+// HLSProfile is a bitrate to package each song at.
+type HLSProfile struct {
+	Name    string
+	Bitrate int
+}
+
+// HLSProfiles are the renditions every song is packaged at.
+var HLSProfiles = []HLSProfile{
+	{"64k", 64000},
+	{"128k", 128000},
+	{"256k", 256000},
+}
+
+// HLSRendition is one bitrate variant of a packaged song. Playlist is
+// relative to the song's HLS directory.
+type HLSRendition struct {
+	Name     string  `json:"name" bson:"name"`
+	Bitrate  int     `json:"bitrate" bson:"bitrate"`
+	Codecs   string  `json:"codecs" bson:"codecs"`
+	Playlist string  `json:"playlist" bson:"playlist"`
+	Segments int     `json:"segments" bson:"segments"`
+	Duration float64 `json:"duration" bson:"duration"`
+}
+
+// TranscodeFunc runs one encode with the given ffmpeg arguments.
+type TranscodeFunc func(ctx context.Context, args []string) error
+
+// HLSArgs builds the ffmpeg arguments that encode input as one VOD
+// rendition in outDir.
+func HLSArgs(input, outDir string, p HLSProfile) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-i", input,
+		"-vn", "-map", "0:a:0",
+		"-c:a", "aac", "-b:a", strconv.Itoa(p.Bitrate), "-ar", "44100", "-ac", "2",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "mpegts",
+		"-hls_segment_filename", filepath.Join(outDir, "seg_%04d.ts"),
+		filepath.Join(outDir, HLSVariantPlaylist),
+	}
+}
+
+// ParseMediaPlaylist counts the segments of a variant playlist and sums
+// their durations.
+func ParseMediaPlaylist(r io.Reader) (segments int, duration float64, err error) {
+	sc := bufio.NewScanner(r)
+	first := true
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if first {
+			if line != "#EXTM3U" {
+				return 0, 0, errors.New("not an m3u8 playlist")
+			}
+			first = false
+			continue
+		}
+		rest, ok := strings.CutPrefix(line, "#EXTINF:")
+		if !ok {
+			continue
+		}
+		secs, _, _ := strings.Cut(rest, ",")
+		d, err := strconv.ParseFloat(secs, 64)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("bad segment duration %q", secs)
+		}
+		segments++
+		duration += d
+	}
+	if err := sc.Err(); err != nil {
+		return 0, 0, err
+	}
+	if first {
+		return 0, 0, errors.New("not an m3u8 playlist")
+	}
+	if segments == 0 {
+		return 0, 0, errors.New("playlist has no segments")
+	}
+	return segments, duration, nil
+}
+
+// RenderMasterPlaylist lists renditions, lowest bitrate first so players
+// start cautiously and step up.
+func RenderMasterPlaylist(renditions []HLSRendition) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n%s\n", r.Bitrate, r.Codecs, r.Playlist)
+	}
+	return b.Bytes()
+}
+
+// PackageHLS encodes input at every profile and writes the variant and
+// master playlists to outDir. Output is assembled in a scratch directory
+// and swapped in at the end, so a failed run leaves earlier output intact.
+func PackageHLS(ctx context.Context, input, outDir string, profiles []HLSProfile, transcode TranscodeFunc) ([]HLSRendition, error) {
+	if _, err := os.Stat(input); err != nil {
+		return nil, err
+	}
+	tmp := outDir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	renditions := make([]HLSRendition, 0, len(profiles))
+	for _, p := range profiles {
+		dir := filepath.Join(tmp, p.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := transcode(ctx, HLSArgs(input, dir, p)); err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(filepath.Join(dir, HLSVariantPlaylist))
+		if err != nil {
+			return nil, err
+		}
+		segments, duration, err := ParseMediaPlaylist(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s rendition: %w", p.Name, err)
+		}
+		renditions = append(renditions, HLSRendition{
+			Name:     p.Name,
+			Bitrate:  p.Bitrate,
+			Codecs:   hlsCodecs,
+			Playlist: path.Join(p.Name, HLSVariantPlaylist),
+			Segments: segments,
+			Duration: duration,
+		})
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, HLSMasterPlaylist), RenderMasterPlaylist(renditions), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, outDir); err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
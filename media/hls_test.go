@@ -0,0 +1,168 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "hls", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseMediaPlaylist(t *testing.T) {
+	segments, duration, err := ParseMediaPlaylist(openFixture(t, "index.m3u8"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if segments != 3 || duration != 14.5 {
+		t.Errorf("got %d segments, %gs; want 3 segments, 14.5s", segments, duration)
+	}
+}
+
+func TestParseMediaPlaylistRejects(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    string
+	}{
+		{"missing_header.m3u8", "not an m3u8 playlist"},
+		{"no_segments.m3u8", "playlist has no segments"},
+		{"bad_extinf.m3u8", `bad segment duration "abc"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			_, _, err := ParseMediaPlaylist(openFixture(t, tt.fixture))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMasterPlaylist(t *testing.T) {
+	got := string(RenderMasterPlaylist([]HLSRendition{
+		{Name: "64k", Bitrate: 64000, Codecs: hlsCodecs, Playlist: "64k/index.m3u8"},
+		{Name: "128k", Bitrate: 128000, Codecs: hlsCodecs, Playlist: "128k/index.m3u8"},
+	}))
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"mp4a.40.2\"\n64k/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\"\n128k/index.m3u8\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// fakeTranscoder copies a fixture to the variant playlist named by the
+// ffmpeg arguments instead of encoding. It fails for the profile whose
+// bitrate is failAt.
+func fakeTranscoder(t *testing.T, fixture string, failAt int) TranscodeFunc {
+	playlist, err := os.ReadFile(filepath.Join("testdata", "hls", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(_ context.Context, args []string) error {
+		for i, a := range args {
+			if a == "-b:a" && args[i+1] == strconv.Itoa(failAt) {
+				return errors.New("encoder crashed")
+			}
+		}
+		return os.WriteFile(args[len(args)-1], playlist, 0644)
+	}
+}
+
+// packagingDirs returns an input file and the output directory for it.
+func packagingDirs(t *testing.T) (input, outDir string) {
+	dir := t.TempDir()
+	input = filepath.Join(dir, "song.mp3")
+	if err := os.WriteFile(input, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return input, filepath.Join(dir, "song.hls")
+}
+
+func TestPackageHLS(t *testing.T) {
+	input, outDir := packagingDirs(t)
+
+	renditions, err := PackageHLS(context.Background(), input, outDir, HLSProfiles, fakeTranscoder(t, "index.m3u8", 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(renditions) != len(HLSProfiles) {
+		t.Fatalf("got %d renditions, want %d", len(renditions), len(HLSProfiles))
+	}
+	for i, r := range renditions {
+		p := HLSProfiles[i]
+		if r.Name != p.Name || r.Bitrate != p.Bitrate || r.Segments != 3 || r.Duration != 14.5 {
+			t.Errorf("rendition %d = %+v", i, r)
+		}
+		if _, err := os.Stat(filepath.Join(outDir, filepath.FromSlash(r.Playlist))); err != nil {
+			t.Errorf("variant playlist missing: %v", err)
+		}
+	}
+
+	master, err := os.ReadFile(filepath.Join(outDir, HLSMasterPlaylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(master) != string(RenderMasterPlaylist(renditions)) {
+		t.Errorf("master playlist does not list the renditions:\n%s", master)
+	}
+	if _, err := os.Stat(outDir + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("scratch directory left behind")
+	}
+}
+
+func TestPackageHLSFailureKeepsPreviousOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		transcode func(t *testing.T) TranscodeFunc
+		wantErr   string
+	}{
+		{"encoder fails", func(t *testing.T) TranscodeFunc { return fakeTranscoder(t, "index.m3u8", 128000) }, "encoder crashed"},
+		{"bad playlist", func(t *testing.T) TranscodeFunc { return fakeTranscoder(t, "no_segments.m3u8", 0) }, "64k rendition: playlist has no segments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, outDir := packagingDirs(t)
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			old := filepath.Join(outDir, HLSMasterPlaylist)
+			if err := os.WriteFile(old, []byte("previous"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := PackageHLS(context.Background(), input, outDir, HLSProfiles, tt.transcode(t))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if got, err := os.ReadFile(old); err != nil || string(got) != "previous" {
+				t.Errorf("previous output changed: %q, %v", got, err)
+			}
+			if _, err := os.Stat(outDir + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("scratch directory left behind")
+			}
+		})
+	}
+}
+
+func TestPackageHLSMissingInput(t *testing.T) {
+	dir := t.TempDir()
+	called := false
+	transcode := func(context.Context, []string) error { called = true; return nil }
+	if _, err := PackageHLS(context.Background(), filepath.Join(dir, "missing.mp3"), filepath.Join(dir, "out.hls"), HLSProfiles, transcode); !os.IsNotExist(err) {
+		t.Errorf("got error %v, want not-exist", err)
+	}
+	if called {
+		t.Error("transcoder ran without input")
+	}
+}
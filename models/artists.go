@@ -20,6 +20,7 @@ type Artist struct {
 	Members   []BandMember      `bson:"members,omitempty" json:"members,omitempty"` // ✅ ADD THIS
 	CreatedAt time.Time         `json:"createdAt" bson:"createdAt"`
 	CreatorID string            `bson:"creatorid" json:"creatorid"`
+	Followers int               `bson:"followers,omitempty" json:"followers,omitempty"`
 }
 
 type BandMember struct {
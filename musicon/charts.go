@@ -0,0 +1,435 @@
+package musicon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Chart types.
+const (
+	ChartSongs   = "songs"
+	ChartAlbums  = "albums"
+	ChartArtists = "artists"
+)
+
+// Chart windows.
+const (
+	ChartDay   = "day"
+	ChartWeek  = "week"
+	ChartMonth = "month"
+)
+
+const (
+	chartRefreshInterval = 15 * time.Minute
+	chartSize            = 100
+)
+
+// chartWindows are the window lengths. Each also divides time into
+// periods, whose final snapshot is what the next period's movement is
+// measured against.
+var chartWindows = map[string]time.Duration{
+	ChartDay:   24 * time.Hour,
+	ChartWeek:  7 * 24 * time.Hour,
+	ChartMonth: 30 * 24 * time.Hour,
+}
+
+// ChartEntry is one ranked item in a chart snapshot. PreviousRank is the
+// item's rank in the previous period's chart, or 0 if it was not on it;
+// Movement is positive when an item climbed.
+type ChartEntry struct {
+	ID           string `json:"id" bson:"id"`
+	Rank         int    `json:"rank" bson:"rank"`
+	PreviousRank int    `json:"previousRank" bson:"previousRank"`
+	Movement     int    `json:"movement" bson:"movement"`
+	Plays        int    `json:"plays" bson:"plays"`
+}
+
+// ChartSnapshot is the computed state of one chart in one period, updated
+// on every refresh until the period ends. Genre and Language are empty for
+// overall charts.
+type ChartSnapshot struct {
+	ChartID    string       `json:"chartid" bson:"chartid"`
+	Type       string       `json:"type" bson:"type"`
+	Window     string       `json:"window" bson:"window"`
+	Period     time.Time    `json:"period" bson:"period"`
+	Genre      string       `json:"genre,omitempty" bson:"genre,omitempty"`
+	Language   string       `json:"language,omitempty" bson:"language,omitempty"`
+	Entries    []ChartEntry `json:"entries" bson:"entries"`
+	ComputedAt time.Time    `json:"computedAt" bson:"computedAt"`
+}
+
+// ChartItem is a chart entry resolved to the song, album or artist.
+type ChartItem struct {
+	ChartEntry
+	Item interface{} `json:"item"`
+}
+
+func chartID(chartType, window, genre, language string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", chartType, window, genre, language)
+}
+
+// chartPeriod returns the start of the period of window that t falls in.
+// Periods are counted from the Unix epoch, so daily charts roll over at
+// midnight UTC.
+func chartPeriod(window string, t time.Time) time.Time {
+	return t.UTC().Truncate(chartWindows[window])
+}
+
+// songPlays is a song's play count in a window with the fields charts are
+// broken down by.
+type songPlays struct {
+	SongID   string `bson:"_id"`
+	Plays    int    `bson:"plays"`
+	ArtistID string `bson:"artistid"`
+	Genre    string `bson:"genre"`
+	Language string `bson:"language"`
+}
+
+// windowPlays counts plays of published songs since the given time.
+func windowPlays(ctx context.Context, since time.Time) ([]songPlays, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"startedAt": bson.M{"$gte": since}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$songid", "plays": bson.M{"$sum": 1}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         db.SongsCollection.Name(),
+			"localField":   "_id",
+			"foreignField": "songid",
+			"as":           "song",
+		}}},
+		{{Key: "$unwind", Value: "$song"}},
+		{{Key: "$match", Value: bson.M{"song.published": true}}},
+		{{Key: "$project", Value: bson.M{
+			"plays":    1,
+			"artistid": "$song.artistid",
+			"genre":    "$song.genre",
+			"language": "$song.language",
+		}}},
+	}
+
+	cursor, err := db.ListeningHistoryCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []songPlays
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// albumsBySong maps each song in plays to the published albums it is on.
+func albumsBySong(ctx context.Context, plays []songPlays) (map[string][]string, error) {
+	ids := make([]string, len(plays))
+	for i, p := range plays {
+		ids[i] = p.SongID
+	}
+	albums, err := utils.FindAndDecode[Album](ctx, db.AlbumsCollection,
+		bson.M{"published": true, "songs": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"albumid": 1, "songs": 1}))
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]string{}
+	for _, a := range albums {
+		for _, s := range a.Songs {
+			out[s] = append(out[s], a.AlbumID)
+		}
+	}
+	return out, nil
+}
+
+// tally accumulates play counts for one chart.
+type tally map[string]int
+
+func (t tally) ranked() []ChartEntry {
+	entries := make([]ChartEntry, 0, len(t))
+	for id, plays := range t {
+		entries = append(entries, ChartEntry{ID: id, Plays: plays})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Plays != entries[j].Plays {
+			return entries[i].Plays > entries[j].Plays
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	if len(entries) > chartSize {
+		entries = entries[:chartSize]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
+
+// buildWindowCharts computes every chart for one window: each type
+// overall, per genre and per language.
+func buildWindowCharts(ctx context.Context, window string, now time.Time) (map[string]*ChartSnapshot, error) {
+	plays, err := windowPlays(ctx, now.Add(-chartWindows[window]))
+	if err != nil {
+		return nil, err
+	}
+	albums, err := albumsBySong(ctx, plays)
+	if err != nil {
+		return nil, err
+	}
+
+	charts := map[string]*ChartSnapshot{}
+	tallies := map[string]tally{}
+	add := func(chartType, genre, language, id string, n int) {
+		key := chartID(chartType, window, genre, language)
+		if charts[key] == nil {
+			charts[key] = &ChartSnapshot{
+				ChartID: key, Type: chartType, Window: window, Period: chartPeriod(window, now),
+				Genre: genre, Language: language,
+			}
+			tallies[key] = tally{}
+		}
+		tallies[key][id] += n
+	}
+
+	for _, p := range plays {
+		scopes := [][2]string{{"", ""}}
+		if p.Genre != "" {
+			scopes = append(scopes, [2]string{p.Genre, ""})
+		}
+		if p.Language != "" {
+			scopes = append(scopes, [2]string{"", p.Language})
+		}
+		for _, scope := range scopes {
+			add(ChartSongs, scope[0], scope[1], p.SongID, p.Plays)
+			if p.ArtistID != "" {
+				add(ChartArtists, scope[0], scope[1], p.ArtistID, p.Plays)
+			}
+			for _, albumID := range albums[p.SongID] {
+				add(ChartAlbums, scope[0], scope[1], albumID, p.Plays)
+			}
+		}
+	}
+
+	for key, chart := range charts {
+		chart.Entries = tallies[key].ranked()
+		chart.ComputedAt = now
+	}
+	return charts, nil
+}
+
+// saveChart stores the snapshot for its period, filling in rank movement
+// against the final snapshot of the latest earlier period, normally the one
+// just before. Refreshes within a period therefore all compare against the
+// same chart, and restarts do not reset it.
+func saveChart(ctx context.Context, chart *ChartSnapshot) error {
+	var prev ChartSnapshot
+	err := db.ChartsCollection.FindOne(ctx,
+		bson.M{"chartid": chart.ChartID, "period": bson.M{"$lt": chart.Period}},
+		options.FindOne().SetSort(bson.D{{Key: "period", Value: -1}}),
+	).Decode(&prev)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	prevRanks := make(map[string]int, len(prev.Entries))
+	for _, e := range prev.Entries {
+		prevRanks[e.ID] = e.Rank
+	}
+	for i := range chart.Entries {
+		e := &chart.Entries[i]
+		if r, ok := prevRanks[e.ID]; ok {
+			e.PreviousRank = r
+			e.Movement = r - e.Rank
+		}
+	}
+
+	_, err = db.ChartsCollection.ReplaceOne(ctx,
+		bson.M{"chartid": chart.ChartID, "period": chart.Period}, chart, options.Replace().SetUpsert(true))
+	return err
+}
+
+// refreshCharts recomputes and stores every chart. Charts that no longer
+// have any plays are emptied rather than left stale. Only the current and
+// previous period of each window are kept.
+func refreshCharts(ctx context.Context) {
+	now := time.Now()
+	for window, length := range chartWindows {
+		opCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		charts, err := buildWindowCharts(opCtx, window, now)
+		if err != nil {
+			cancel()
+			log.Printf("Charts: failed to build %s charts: %v", window, err)
+			continue
+		}
+
+		period := chartPeriod(window, now)
+		previous := period.Add(-length)
+		stale, err := utils.FindAndDecode[ChartSnapshot](opCtx, db.ChartsCollection,
+			bson.M{"window": window, "period": bson.M{"$gte": previous}},
+			options.Find().SetProjection(bson.M{"chartid": 1, "type": 1, "genre": 1, "language": 1}))
+		if err == nil {
+			for _, s := range stale {
+				if charts[s.ChartID] == nil {
+					charts[s.ChartID] = &ChartSnapshot{
+						ChartID: s.ChartID, Type: s.Type, Window: window, Period: period,
+						Genre: s.Genre, Language: s.Language,
+						Entries: []ChartEntry{}, ComputedAt: now,
+					}
+				}
+			}
+		}
+
+		for _, chart := range charts {
+			if err := saveChart(opCtx, chart); err != nil {
+				log.Printf("Charts: failed to save %s: %v", chart.ChartID, err)
+			}
+		}
+
+		// Snapshots from before the window went live have no period and
+		// are dropped along with older periods
+		if _, err := db.ChartsCollection.DeleteMany(opCtx, bson.M{"window": window, "$or": bson.A{
+			bson.M{"period": bson.M{"$lt": previous}},
+			bson.M{"period": bson.M{"$exists": false}},
+		}}); err != nil {
+			log.Printf("Charts: failed to prune %s charts: %v", window, err)
+		}
+		cancel()
+	}
+}
+
+// StartChartBuilder recomputes chart snapshots from play events every
+// chartRefreshInterval until ctx is cancelled.
+func StartChartBuilder(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(chartRefreshInterval)
+		defer ticker.Stop()
+		for {
+			refreshCharts(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// resolveChartItems loads the songs, albums or artists a chart ranks.
+// Items that have since been unpublished or removed are dropped.
+func resolveChartItems(ctx context.Context, chartType string, entries []ChartEntry, viewerID string) ([]ChartItem, error) {
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+
+	byID := map[string]interface{}{}
+	switch chartType {
+	case ChartSongs:
+		songs, err := fetchSongsByIDs(ctx, ids, viewerID)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range songs {
+			byID[s.SongID] = s
+		}
+	case ChartAlbums:
+		albums, err := utils.FindAndDecode[Album](ctx, db.AlbumsCollection, bson.M{"albumid": bson.M{"$in": ids}, "published": true})
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range albums {
+			byID[a.AlbumID] = a
+		}
+	default:
+		artists, err := utils.FindAndDecode[models.Artist](ctx, db.ArtistsCollection, bson.M{"artistid": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range artists {
+			byID[a.ArtistID] = a
+		}
+	}
+
+	items := make([]ChartItem, 0, len(entries))
+	for _, e := range entries {
+		if item, ok := byID[e.ID]; ok {
+			items = append(items, ChartItem{ChartEntry: e, Item: item})
+		}
+	}
+	return items, nil
+}
+
+// GetChart returns a precomputed chart. The type is songs, albums or
+// artists; ?window= is day, week (default) or month, and ?genre= or
+// ?language= narrows it.
+func GetChart(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	chartType := ps.ByName("type")
+	if chartType != ChartSongs && chartType != ChartAlbums && chartType != ChartArtists {
+		respondError(w, http.StatusBadRequest, "Chart type must be songs, albums or artists")
+		return
+	}
+
+	q := r.URL.Query()
+	window := strings.ToLower(q.Get("window"))
+	if window == "" {
+		window = ChartWeek
+	}
+	if _, ok := chartWindows[window]; !ok {
+		respondError(w, http.StatusBadRequest, "Window must be day, week or month")
+		return
+	}
+	genre, language := q.Get("genre"), q.Get("language")
+	if genre != "" && language != "" {
+		respondError(w, http.StatusBadRequest, "Filter by genre or language, not both")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var chart ChartSnapshot
+	err := db.ChartsCollection.FindOne(ctx,
+		bson.M{"chartid": chartID(chartType, window, genre, language)},
+		options.FindOne().SetSort(bson.D{{Key: "period", Value: -1}}),
+	).Decode(&chart)
+	if err == mongo.ErrNoDocuments {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"type":   chartType,
+			"window": window,
+			"items":  []ChartItem{},
+		}, "Chart not available yet")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch chart")
+		return
+	}
+
+	limit, page := getPaginationParams(r)
+	start, end := pageBounds(int64(len(chart.Entries)), limit, page)
+
+	items, err := resolveChartItems(ctx, chartType, chart.Entries[start:end], utils.GetUserIDFromRequest(r))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch chart items")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"type":       chart.Type,
+		"window":     chart.Window,
+		"genre":      chart.Genre,
+		"language":   chart.Language,
+		"computedAt": chart.ComputedAt,
+		"items":      items,
+	}, "Chart fetched successfully")
+}
@@ -0,0 +1,221 @@
+package musicon
+
+import (
+	"context"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Collaborator roles and invitation states.
+const (
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+
+	InvitePending  = "pending"
+	InviteAccepted = "accepted"
+)
+
+// maxCollaborators caps how many users may be invited to one playlist.
+const maxCollaborators = 50
+
+func validRole(role string) bool {
+	return role == RoleEditor || role == RoleViewer
+}
+
+// editablePlaylistFilter matches playlistID when userID owns it or is an
+// accepted editor on it.
+func editablePlaylistFilter(playlistID, userID string) bson.M {
+	return live(bson.M{
+		"playlistid": playlistID,
+		"$or": bson.A{
+			bson.M{"userid": userID},
+			bson.M{"collaborators": bson.M{"$elemMatch": bson.M{
+				"userid": userID,
+				"role":   RoleEditor,
+				"status": InviteAccepted,
+			}}},
+		},
+	})
+}
+
+// isCollaborator reports whether userID has accepted an invite to p.
+func isCollaborator(p *Playlist, userID string) bool {
+	if userID == "" {
+		return false
+	}
+	for _, c := range p.Collaborators {
+		if c.UserID == userID && c.Status == InviteAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// InviteCollaborator invites a user to a playlist, or changes the role of an
+// existing invite. Only the owner may invite.
+func InviteCollaborator(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	var body struct {
+		UserID string `json:"userid"`
+		Role   string `json:"role"`
+	}
+	if err := utils.ParseJSON(r, &body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON input")
+		return
+	}
+	if body.UserID == "" || body.UserID == userID {
+		respondError(w, http.StatusBadRequest, "Invalid collaborator user ID")
+		return
+	}
+	if body.Role == "" {
+		body.Role = RoleEditor
+	} else if !validRole(body.Role) {
+		respondError(w, http.StatusBadRequest, "Role must be editor or viewer")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// Existing invite: only the role changes, acceptance is kept
+	res, err := db.PlaylistsCollection.UpdateOne(ctx,
+		live(bson.M{"playlistid": playlistID, "userid": userID, "collaborators.userid": body.UserID}),
+		bson.M{"$set": bson.M{"collaborators.$.role": body.Role, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to invite collaborator")
+		return
+	}
+
+	if res.MatchedCount == 0 {
+		invite := Collaborator{
+			UserID:    body.UserID,
+			Role:      body.Role,
+			Status:    InvitePending,
+			InvitedBy: userID,
+			InvitedAt: time.Now(),
+		}
+		filter := live(bson.M{
+			"playlistid":           playlistID,
+			"userid":               userID,
+			"collaborators.userid": bson.M{"$ne": body.UserID},
+			"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$ifNull": bson.A{"$collaborators", bson.A{}}}},
+				maxCollaborators,
+			}},
+		})
+		res, err = db.PlaylistsCollection.UpdateOne(ctx, filter, bson.M{
+			"$push": bson.M{"collaborators": invite},
+			"$set":  bson.M{"updatedAt": time.Now()},
+		})
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to invite collaborator")
+			return
+		}
+		if res.MatchedCount == 0 {
+			respondError(w, http.StatusForbidden, "Playlist not found, unauthorized or collaborator limit reached")
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"playlist_id": playlistID,
+		"userid":      body.UserID,
+		"role":        body.Role,
+	}, "Collaborator invited")
+}
+
+// AcceptCollaboration accepts the caller's pending invite to a playlist.
+func AcceptCollaboration(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := live(bson.M{
+		"playlistid": playlistID,
+		"collaborators": bson.M{"$elemMatch": bson.M{
+			"userid": userID,
+			"status": InvitePending,
+		}},
+	})
+	update := bson.M{"$set": bson.M{
+		"collaborators.$.status":     InviteAccepted,
+		"collaborators.$.acceptedAt": time.Now(),
+	}}
+
+	res, err := db.PlaylistsCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to accept invite")
+		return
+	}
+	if res.MatchedCount == 0 {
+		respondError(w, http.StatusNotFound, "No pending invite for this playlist")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"playlist_id": playlistID}, "Invite accepted")
+}
+
+// RevokeCollaborator removes a collaborator or pending invite. The owner may
+// remove anyone; a collaborator may only remove themselves.
+func RevokeCollaborator(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+	target := ps.ByName("userid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := live(bson.M{"playlistid": playlistID, "userid": userID, "collaborators.userid": target})
+	if target == userID {
+		filter = live(bson.M{"playlistid": playlistID, "collaborators.userid": userID})
+	}
+	update := bson.M{
+		"$pull": bson.M{"collaborators": bson.M{"userid": target}},
+		"$set":  bson.M{"updatedAt": time.Now()},
+	}
+
+	res, err := db.PlaylistsCollection.UpdateOne(ctx, filter, update)
+	if err != nil || res.MatchedCount == 0 {
+		respondError(w, http.StatusForbidden, "Playlist or collaborator not found, or unauthorized")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"playlist_id": playlistID,
+		"userid":      target,
+	}, "Collaborator removed")
+}
+
+// GetPlaylistInvites lists playlists the caller has been invited to but has
+// not yet accepted.
+func GetPlaylistInvites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := live(bson.M{"collaborators": bson.M{"$elemMatch": bson.M{
+		"userid": userID,
+		"status": InvitePending,
+	}}})
+	playlists, err := utils.FindAndDecode[Playlist](ctx, db.PlaylistsCollection, filter)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch invites")
+		return
+	}
+	if playlists == nil {
+		playlists = []Playlist{}
+	}
+
+	respondJSON(w, http.StatusOK, playlists, "Playlist invites fetched")
+}
@@ -0,0 +1,115 @@
+package musicon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"naevis/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errBadDuration = errors.New("unrecognised duration")
+
+// parseSongDuration converts the free-form Song.Duration string to whole
+// seconds. Accepted forms, after trimming whitespace:
+//
+//	"245"        plain seconds
+//	"4:05"       minutes:seconds
+//	"1:02:05"    hours:minutes:seconds
+//	"4m5s"       Go duration syntax (fractions are truncated)
+//
+// In the colon forms every field after the first must be below 60. Empty,
+// negative or otherwise malformed values return errBadDuration.
+func parseSongDuration(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errBadDuration
+	}
+
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return 0, errBadDuration
+		}
+		total := 0
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || (i > 0 && (n >= 60 || len(part) != 2)) {
+				return 0, errBadDuration
+			}
+			total = total*60 + n
+		}
+		return total, nil
+	}
+
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0, errBadDuration
+		}
+		return n, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errBadDuration
+	}
+	return int(d / time.Second), nil
+}
+
+// formatSongDuration renders whole seconds in the "m:ss" or "h:mm:ss"
+// form parseSongDuration accepts.
+func formatSongDuration(seconds int) string {
+	h, m, sec := seconds/3600, seconds/60%60, seconds%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%d:%02d", m, sec)
+}
+
+// refreshPlaylistStats recomputes p.Duration and p.TrackCount from its
+// entries, or from the current rule matches for smart playlists. Only
+// published songs count, matching what GetPlaylistSongs returns; songs with
+// an unparseable duration count as zero seconds.
+func refreshPlaylistStats(ctx context.Context, p *Playlist) error {
+	ids, err := playlistSongIDs(ctx, p)
+	if err != nil {
+		return err
+	}
+	seconds := make(map[string]int, len(ids))
+
+	if len(ids) > 0 {
+		cursor, err := db.SongsCollection.Find(ctx,
+			bson.M{"songid": bson.M{"$in": ids}, "published": true},
+			options.Find().SetProjection(bson.M{"songid": 1, "duration": 1}))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			var s Song
+			if err := cursor.Decode(&s); err != nil {
+				return err
+			}
+			secs, _ := parseSongDuration(s.Duration)
+			seconds[s.SongID] = secs
+		}
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+	}
+
+	p.Duration, p.TrackCount = 0, 0
+	for _, id := range ids {
+		if secs, ok := seconds[id]; ok {
+			p.Duration += secs
+			p.TrackCount++
+		}
+	}
+	return nil
+}
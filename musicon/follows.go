@@ -0,0 +1,123 @@
+package musicon
+
+import (
+	"context"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PlaylistFollow records that a user follows someone else's playlist.
+type PlaylistFollow struct {
+	UserID     string    `json:"userid" bson:"userid"`
+	PlaylistID string    `json:"playlistid" bson:"playlistid"`
+	FollowedAt time.Time `json:"followedAt" bson:"followedAt"`
+}
+
+// Library listing scopes for GetUserPlaylists.
+const (
+	LibraryOwned    = "owned"
+	LibraryFollowed = "followed"
+	LibraryAll      = "all"
+)
+
+// followedPlaylistIDs returns the IDs of every playlist userID follows.
+func followedPlaylistIDs(ctx context.Context, userID string) ([]string, error) {
+	follows, err := utils.FindAndDecode[PlaylistFollow](ctx, db.PlaylistFollowsCollection,
+		bson.M{"userid": userID},
+		options.Find().SetProjection(bson.M{"playlistid": 1}))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(follows))
+	for i, f := range follows {
+		ids[i] = f.PlaylistID
+	}
+	return ids, nil
+}
+
+// libraryFilter builds the playlist query for a library scope. Owned covers
+// playlists the user created or collaborates on; followed playlists are only
+// listed while they remain viewable.
+func libraryFilter(ctx context.Context, userID, scope string) (bson.M, error) {
+	owned := bson.A{
+		bson.M{"userid": userID},
+		bson.M{"collaborators": bson.M{"$elemMatch": bson.M{"userid": userID, "status": InviteAccepted}}},
+	}
+	if scope == LibraryOwned {
+		return live(bson.M{"$or": owned}), nil
+	}
+
+	ids, err := followedPlaylistIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	followed := bson.M{
+		"playlistid": bson.M{"$in": ids},
+		"visibility": bson.M{"$in": bson.A{VisibilityPublic, VisibilityUnlisted}},
+	}
+	if scope == LibraryFollowed {
+		return live(followed), nil
+	}
+	return live(bson.M{"$or": append(owned, followed)}), nil
+}
+
+// addFollow stores a follow and reports whether it is new.
+func addFollow(ctx context.Context, userID, playlistID string) (bool, error) {
+	res, err := db.PlaylistFollowsCollection.UpdateOne(ctx,
+		bson.M{"userid": userID, "playlistid": playlistID},
+		bson.M{"$setOnInsert": PlaylistFollow{UserID: userID, PlaylistID: playlistID, FollowedAt: time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+// removeFollow deletes a follow and reports whether one existed.
+func removeFollow(ctx context.Context, userID, playlistID string) (bool, error) {
+	res, err := db.PlaylistFollowsCollection.DeleteOne(ctx, bson.M{"userid": userID, "playlistid": playlistID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// FollowPlaylist subscribes the caller to another user's playlist. Only a
+// new follow moves the follower count, so repeated calls are idempotent.
+func FollowPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := setLike(ctx, userID, LikeTypePlaylist, playlistID, true); err != nil {
+		respondLikeError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"playlist_id": playlistID}, "Playlist followed")
+}
+
+// UnfollowPlaylist removes the caller's follow of a playlist.
+func UnfollowPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := setLike(ctx, userID, LikeTypePlaylist, playlistID, false); err != nil {
+		respondLikeError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"playlist_id": playlistID}, "Playlist unfollowed")
+}
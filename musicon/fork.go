@@ -0,0 +1,209 @@
+package musicon
+
+import (
+	"context"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fork source types.
+const (
+	ForkFromPlaylist = "playlist"
+	ForkFromAlbum    = "album"
+	ForkFromLikes    = "likes"
+)
+
+// maxForkedLikes caps how many liked songs one fork copies, newest first.
+const maxForkedLikes = 5000
+
+type forkRequest struct {
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+}
+
+// parseForkRequest reads the optional fork body. An empty body keeps the
+// source name and makes the copy private.
+func parseForkRequest(w http.ResponseWriter, r *http.Request) (forkRequest, bool) {
+	var req forkRequest
+	if r.ContentLength != 0 {
+		if err := utils.ParseJSON(r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid JSON input")
+			return req, false
+		}
+	}
+	if len(req.Name) > 100 {
+		respondError(w, http.StatusBadRequest, "Playlist name must be 1-100 characters")
+		return req, false
+	}
+	if req.Visibility == "" {
+		req.Visibility = VisibilityPrivate
+	} else if !validVisibility(req.Visibility) {
+		respondError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public")
+		return req, false
+	}
+	return req, true
+}
+
+// createFork stores a new playlist for userID holding songIDs in order.
+func createFork(ctx context.Context, userID string, req forkRequest, src ForkSource, description string, songIDs []string) (Playlist, error) {
+	name := req.Name
+	if name == "" {
+		name = src.Name
+		if len(name) > 100 {
+			name = strings.ToValidUTF8(name[:100], "")
+		}
+	}
+
+	fork := newPlaylist(userID, name, description, req.Visibility)
+	fork.ForkedFrom = &src
+	for _, id := range songIDs {
+		fork.Songs = append(fork.Songs, newPlaylistEntry(id, userID))
+	}
+	if err := refreshPlaylistStats(ctx, &fork); err != nil {
+		return fork, err
+	}
+
+	if _, err := db.PlaylistsCollection.InsertOne(ctx, fork); err != nil {
+		return fork, err
+	}
+	recordPlaylistChange(ctx, fork.PlaylistID, fork.Revision, userID, OpFork, nil, snapshotOf(&fork))
+	return fork, nil
+}
+
+// ForkPlaylist saves a copy of a playlist the caller can view.
+func ForkPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	req, ok := parseForkRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Liked songs used to be the likes_<userid> playlist; clients holding
+	// that ID get a copy of the caller's likes
+	if playlistID == legacyLikesID(userID) {
+		forkLikedSongs(w, r, userID, req)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var src Playlist
+	err := db.PlaylistsCollection.FindOne(ctx, live(bson.M{"playlistid": playlistID})).Decode(&src)
+	if err == mongo.ErrNoDocuments || (err == nil && !canViewPlaylist(&src, userID)) {
+		respondError(w, http.StatusNotFound, "Playlist not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch playlist")
+		return
+	}
+
+	// A smart playlist is copied as a fixed list of its current matches
+	songIDs, err := playlistSongIDs(ctx, &src)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch songs")
+		return
+	}
+
+	source := ForkSource{Type: ForkFromPlaylist, ID: src.PlaylistID, Name: src.Name}
+	fork, err := createFork(ctx, userID, req, source, src.Description, songIDs)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to copy playlist")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, fork, "Playlist copied successfully")
+}
+
+// ForkAlbum saves a published album as a new playlist owned by the caller.
+func ForkAlbum(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	albumID := ps.ByName("albumid")
+
+	req, ok := parseForkRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var album Album
+	err := db.AlbumsCollection.FindOne(ctx, bson.M{"albumid": albumID, "published": true}).Decode(&album)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Album not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch album")
+		return
+	}
+
+	source := ForkSource{Type: ForkFromAlbum, ID: album.AlbumID, Name: album.Title}
+	fork, err := createFork(ctx, userID, req, source, album.Description, album.Songs)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to copy album")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, fork, "Album copied to playlist successfully")
+}
+
+// ForkLikedSongs saves the caller's liked songs as a new playlist.
+func ForkLikedSongs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req, ok := parseForkRequest(w, r)
+	if !ok {
+		return
+	}
+	forkLikedSongs(w, r, utils.GetUserIDFromRequest(r), req)
+}
+
+// forkLikedSongs copies userID's published liked songs, most recently liked
+// first, into a new playlist.
+func forkLikedSongs(w http.ResponseWriter, r *http.Request, userID string, req forkRequest) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	likes, err := utils.FindAndDecode[Like](ctx, db.LikesCollection,
+		bson.M{"userid": userID, "entityType": LikeTypeSong},
+		options.Find().
+			SetSort(bson.D{{Key: "likedAt", Value: -1}, {Key: "entityid", Value: 1}}).
+			SetProjection(bson.M{"entityid": 1}).
+			SetLimit(maxForkedLikes))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch likes")
+		return
+	}
+	ids := likedIDs(likes)
+	published, err := publishedSongIDs(ctx, ids)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch songs")
+		return
+	}
+	songIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if published[id] {
+			songIDs = append(songIDs, id)
+		}
+	}
+
+	source := ForkSource{Type: ForkFromLikes, ID: legacyLikesID(userID), Name: "Liked Songs"}
+	fork, err := createFork(ctx, userID, req, source, "", songIDs)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to copy liked songs")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, fork, "Liked songs copied to playlist successfully")
+}
@@ -0,0 +1,180 @@
+package musicon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Operations recorded in the playlist change log.
+const (
+	OpCreate          = "create"
+	OpFork            = "fork"
+	OpAddSongs        = "add_songs"
+	OpRemoveSongs     = "remove_songs"
+	OpMoveEntry       = "move_entry"
+	OpUpdateInfo      = "update_info"
+	OpUpdateRules     = "update_rules"
+	OpDelete          = "delete"
+	OpRestoreRevision = "restore_revision"
+)
+
+// PlaylistSnapshot is the user-editable state of a playlist at one revision.
+type PlaylistSnapshot struct {
+	Name        string          `json:"name" bson:"name"`
+	Description string          `json:"description" bson:"description"`
+	CoverURL    string          `json:"coverUrl,omitempty" bson:"coverUrl,omitempty"`
+	Visibility  string          `json:"visibility" bson:"visibility"`
+	Songs       []PlaylistEntry `json:"songs" bson:"songs"`
+	Rules       *SmartRules     `json:"rules,omitempty" bson:"rules,omitempty"`
+}
+
+// PlaylistChange is one append-only history record. Revision is the
+// playlist revision the change produced; Before is nil for creations and
+// After is nil for deletions.
+type PlaylistChange struct {
+	PlaylistID string            `json:"playlistid" bson:"playlistid"`
+	Revision   int64             `json:"revision" bson:"revision"`
+	Actor      string            `json:"actor" bson:"actor"`
+	Op         string            `json:"op" bson:"op"`
+	Before     *PlaylistSnapshot `json:"before,omitempty" bson:"before,omitempty"`
+	After      *PlaylistSnapshot `json:"after,omitempty" bson:"after,omitempty"`
+	At         time.Time         `json:"at" bson:"at"`
+}
+
+func snapshotOf(p *Playlist) *PlaylistSnapshot {
+	songs := make([]PlaylistEntry, len(p.Songs))
+	copy(songs, p.Songs)
+	return &PlaylistSnapshot{
+		Name:        p.Name,
+		Description: p.Description,
+		CoverURL:    p.CoverURL,
+		Visibility:  p.Visibility,
+		Songs:       songs,
+		Rules:       p.Rules,
+	}
+}
+
+// applySnapshot overwrites p's editable state with s.
+func applySnapshot(p *Playlist, s *PlaylistSnapshot) {
+	p.Name = s.Name
+	p.Description = s.Description
+	p.CoverURL = s.CoverURL
+	p.Visibility = s.Visibility
+	p.Songs = make([]PlaylistEntry, len(s.Songs))
+	copy(p.Songs, s.Songs)
+	p.Rules = s.Rules
+}
+
+// recordPlaylistChange appends a history record. The playlist write has
+// already succeeded at this point, so a failure is logged rather than
+// surfaced to the caller.
+func recordPlaylistChange(ctx context.Context, playlistID string, revision int64, actor, op string, before, after *PlaylistSnapshot) {
+	change := PlaylistChange{
+		PlaylistID: playlistID,
+		Revision:   revision,
+		Actor:      actor,
+		Op:         op,
+		Before:     before,
+		After:      after,
+		At:         time.Now(),
+	}
+	if _, err := db.PlaylistHistoryCollection.InsertOne(ctx, change); err != nil {
+		log.Printf("Failed to record %s on playlist %s: %v", op, playlistID, err)
+	}
+}
+
+// GetPlaylistHistory lists a playlist's changes, newest first. Owners and
+// editors may read it.
+func GetPlaylistHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := db.PlaylistsCollection.FindOne(ctx, editablePlaylistFilter(playlistID, userID)).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			respondError(w, http.StatusForbidden, "Playlist not found or unauthorized")
+		} else {
+			respondError(w, http.StatusInternalServerError, "Failed to fetch playlist")
+		}
+		return
+	}
+
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "revision", Value: -1}, {Key: "at", Value: -1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	changes, err := utils.FindAndDecode[PlaylistChange](ctx, db.PlaylistHistoryCollection, bson.M{"playlistid": playlistID}, opts)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch playlist history")
+		return
+	}
+	if changes == nil {
+		changes = []PlaylistChange{}
+	}
+
+	respondJSON(w, http.StatusOK, changes, fmt.Sprintf("History for playlist %s fetched", playlistID))
+}
+
+// RestorePlaylistRevision rolls a playlist back to the state it had right
+// after the given revision. The rollback is itself a new revision, so it can
+// be undone the same way.
+func RestorePlaylistRevision(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	revision, err := strconv.ParseInt(ps.ByName("revision"), 10, 64)
+	if err != nil || revision < 0 {
+		respondError(w, http.StatusBadRequest, "Invalid revision")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var change PlaylistChange
+	err = db.PlaylistHistoryCollection.FindOne(ctx,
+		bson.M{"playlistid": playlistID, "revision": revision, "after": bson.M{"$ne": nil}},
+		options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}}),
+	).Decode(&change)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			respondError(w, http.StatusNotFound, "Revision not found")
+		} else {
+			respondError(w, http.StatusInternalServerError, "Failed to fetch revision")
+		}
+		return
+	}
+
+	p, err := updatePlaylist(ctx, editablePlaylistFilter(playlistID, userID), userID, OpRestoreRevision, func(p *Playlist) error {
+		// Editors may restore songs and rules but not the owner's metadata
+		if p.UserID != userID {
+			p.Songs = make([]PlaylistEntry, len(change.After.Songs))
+			copy(p.Songs, change.After.Songs)
+			p.Rules = change.After.Rules
+			return nil
+		}
+		applySnapshot(p, change.After)
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, p, fmt.Sprintf("Playlist restored to revision %d", revision))
+}
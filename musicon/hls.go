@@ -0,0 +1,301 @@
+package musicon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/media"
+	"naevis/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// HLS packaging states, as stored in SongHLS.Status.
+const (
+	HLSPending    = "pending"
+	HLSProcessing = "processing"
+	HLSReady      = "ready"
+	HLSFailed     = "failed"
+)
+
+const (
+	hlsPath = "/api/v1/musicon/songs/%s/hls/%s/%s"
+
+	hlsPollEvery = time.Minute
+	// hlsJobTimeout bounds one packaging run. A job left processing for
+	// longer is assumed to have died with its worker and is retried.
+	hlsJobTimeout = 30 * time.Minute
+)
+
+// hlsWake nudges the packager when a job is queued, so it does not wait
+// for the next poll.
+var hlsWake = make(chan struct{}, 1)
+
+// --------------------------- Packaging ---------------------------
+
+// hlsDir is where a song's HLS output lives: next to the original audio,
+// named after it.
+func hlsDir(s Song) string {
+	audio := audioFilePath(s)
+	return strings.TrimSuffix(audio, filepath.Ext(audio)) + ".hls"
+}
+
+// ffmpegPath reads FFMPEG_PATH, defaulting to ffmpeg on the PATH.
+func ffmpegPath() string {
+	if v := os.Getenv("FFMPEG_PATH"); v != "" {
+		return v
+	}
+	return "ffmpeg"
+}
+
+// runFFmpeg runs the local ffmpeg binary, reporting its output on failure.
+func runFFmpeg(ctx context.Context, args []string) error {
+	out, err := exec.CommandContext(ctx, ffmpegPath(), args...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		return fmt.Errorf("ffmpeg: %v: %s", err, msg)
+	}
+	return nil
+}
+
+// --------------------------- Job Queue ---------------------------
+
+// queueHLS marks a song for packaging and wakes the packager. It fails
+// with mongo.ErrNoDocuments when the song is missing or already being
+// packaged.
+func queueHLS(ctx context.Context, songID string) error {
+	res, err := db.SongsCollection.UpdateOne(ctx,
+		bson.M{"songid": songID, "hls.status": bson.M{"$ne": HLSProcessing}},
+		bson.M{"$set": bson.M{"hls": SongHLS{Status: HLSPending}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	select {
+	case hlsWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// claimHLSJob takes the oldest pending song, or one whose packaging timed
+// out, and marks it processing. It returns nil when there is nothing to do.
+func claimHLSJob(ctx context.Context) (*Song, error) {
+	now := time.Now()
+	var song Song
+	err := db.SongsCollection.FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"hls.status": HLSPending},
+			bson.M{"hls.status": HLSProcessing, "hls.startedAt": bson.M{"$lt": now.Add(-hlsJobTimeout)}},
+		}},
+		bson.M{"$set": bson.M{"hls.status": HLSProcessing, "hls.startedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &song, nil
+}
+
+// runHLSJob packages a claimed song and records the outcome, unless the
+// job was meanwhile reclaimed by another worker.
+func runHLSJob(ctx context.Context, song *Song) {
+	jobCtx, cancel := context.WithTimeout(ctx, hlsJobTimeout)
+	defer cancel()
+
+	renditions, err := media.PackageHLS(jobCtx, audioFilePath(*song), hlsDir(*song), media.HLSProfiles, runFFmpeg)
+
+	var update bson.M
+	if err != nil {
+		log.Printf("HLS: packaging %s failed: %v", song.SongID, err)
+		update = bson.M{"$set": bson.M{"hls.status": HLSFailed, "hls.error": err.Error()}}
+	} else {
+		update = bson.M{
+			"$set":   bson.M{"hls.status": HLSReady, "hls.renditions": renditions, "hls.packagedAt": time.Now()},
+			"$unset": bson.M{"hls.error": ""},
+		}
+	}
+
+	opCtx, opCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer opCancel()
+	if _, err := db.SongsCollection.UpdateOne(opCtx,
+		bson.M{"songid": song.SongID, "hls.status": HLSProcessing, "hls.startedAt": song.HLS.StartedAt},
+		update); err != nil {
+		log.Printf("HLS: failed to record result for %s: %v", song.SongID, err)
+	}
+}
+
+// StartHLSPackager works through queued songs one at a time until ctx is
+// cancelled, checking for new work when woken by queueHLS and every
+// hlsPollEvery otherwise. Several instances may run it; each job is
+// claimed by exactly one.
+func StartHLSPackager(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(hlsPollEvery)
+		defer ticker.Stop()
+		for {
+			for ctx.Err() == nil {
+				claimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				song, err := claimHLSJob(claimCtx)
+				cancel()
+				if err != nil {
+					log.Printf("HLS: failed to claim job: %v", err)
+					break
+				}
+				if song == nil {
+					break
+				}
+				runHLSJob(ctx, song)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-hlsWake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// --------------------------- Handlers ---------------------------
+
+// hlsURL is the signed URL of a file in a song's HLS output.
+func hlsURL(g streamGrant, file string) string {
+	return fmt.Sprintf(hlsPath, url.PathEscape(g.songID), url.PathEscape(g.token()), file)
+}
+
+// ownsArtist reports whether userID manages the artist profile artistID.
+func ownsArtist(ctx context.Context, userID, artistID string) (bool, error) {
+	if userID == "" || artistID == "" {
+		return false, nil
+	}
+	n, err := db.ArtistsCollection.CountDocuments(ctx, bson.M{"artistid": artistID, "creatorid": userID})
+	return n > 0, err
+}
+
+// PackageSongHLS queues a song for HLS packaging. Only the manager of the
+// song's artist may do so.
+func PackageSongHLS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	songID := ps.ByName("songid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var song Song
+	err := db.SongsCollection.FindOne(ctx, bson.M{"songid": songID}).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch song")
+		return
+	}
+	owner, err := ownsArtist(ctx, userID, song.ArtistID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return
+	}
+	if !owner {
+		respondError(w, http.StatusForbidden, "Only the artist can package this song")
+		return
+	}
+
+	if err := queueHLS(ctx, songID); err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusConflict, "Song is already being packaged")
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to queue packaging")
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, map[string]string{"song_id": songID, "status": HLSPending}, "Packaging queued")
+}
+
+// GetSongHLS reports a published song's HLS packaging state and, once
+// ready, a signed URL of its master playlist.
+func GetSongHLS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	songID := ps.ByName("songid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	song, err := findPublishedSong(ctx, songID)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found or unpublished")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch song")
+		return
+	}
+	if song.HLS == nil {
+		respondError(w, http.StatusNotFound, "Song has not been packaged for HLS")
+		return
+	}
+
+	songs := []Song{song}
+	signStreamURLs(songs, utils.GetUserIDFromRequest(r))
+	respondJSON(w, http.StatusOK, songs[0].HLS, "HLS status fetched")
+}
+
+// ServeSongHLS serves the playlists and segments of a packaged song. The
+// signed grant travels in the path so that relative segment URIs keep it.
+func ServeSongHLS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	songID := ps.ByName("songid")
+
+	grant, ok := grantFromToken(songID, ps.ByName("token"))
+	var valid time.Duration
+	if ok {
+		valid, ok = grant.verify(r)
+	}
+	if !ok {
+		respondError(w, http.StatusForbidden, "Stream link is missing, invalid or expired")
+		return
+	}
+
+	file := path.Clean(ps.ByName("file"))
+	if ext := path.Ext(file); ext != ".m3u8" && ext != ".ts" {
+		respondError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var song Song
+	err := db.SongsCollection.FindOne(ctx, bson.M{"songid": songID, "published": true, "hls.status": HLSReady},
+		options.FindOne().SetProjection(bson.M{"songid": 1, "audioUrl": 1, "audioextn": 1})).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found or not packaged")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch song")
+		return
+	}
+
+	serveAudioFile(w, r, filepath.Join(hlsDir(song), filepath.FromSlash(file)), valid)
+}
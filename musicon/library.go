@@ -0,0 +1,245 @@
+package musicon
+
+import (
+	"context"
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LikedAlbum is an album as returned by the library listing.
+type LikedAlbum struct {
+	Album
+	LikedAt time.Time `json:"likedAt"`
+}
+
+// LikedArtist is a followed artist as returned by the library listing.
+type LikedArtist struct {
+	models.Artist
+	LikedAt time.Time `json:"likedAt"`
+}
+
+// SavedPlaylist is a followed playlist as returned by the library listing.
+type SavedPlaylist struct {
+	Playlist
+	LikedAt time.Time `json:"likedAt"`
+}
+
+// libraryTypes maps the plural path segment of library routes to entity
+// types.
+var libraryTypes = map[string]string{
+	"songs":     LikeTypeSong,
+	"albums":    LikeTypeAlbum,
+	"artists":   LikeTypeArtist,
+	"playlists": LikeTypePlaylist,
+}
+
+func libraryType(w http.ResponseWriter, ps httprouter.Params) (string, bool) {
+	entityType, ok := libraryTypes[ps.ByName("type")]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "Type must be songs, albums, artists or playlists")
+	}
+	return entityType, ok
+}
+
+// SaveToLibrary likes a song or album, follows an artist or saves a
+// playlist for the caller.
+func SaveToLibrary(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	entityType, ok := libraryType(w, ps)
+	if !ok {
+		return
+	}
+	entityID := ps.ByName("id")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := setLike(ctx, userID, entityType, entityID, true); err != nil {
+		respondLikeError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"type":  entityType,
+		"id":    entityID,
+		"saved": true,
+	}, "Saved to library")
+}
+
+// RemoveFromLibrary undoes SaveToLibrary.
+func RemoveFromLibrary(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	entityType, ok := libraryType(w, ps)
+	if !ok {
+		return
+	}
+	entityID := ps.ByName("id")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := setLike(ctx, userID, entityType, entityID, false); err != nil {
+		respondLikeError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"type":  entityType,
+		"id":    entityID,
+		"saved": false,
+	}, "Removed from library")
+}
+
+// GetLibraryItems lists one type of the caller's saved items, most recently
+// saved first. Items that have since become unavailable are left out of the
+// page.
+func GetLibraryItems(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	entityType, ok := libraryType(w, ps)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var items interface{}
+	var err error
+	switch entityType {
+	case LikeTypeSong:
+		items, err = likedSongs(ctx, r, userID)
+	case LikeTypeAlbum:
+		items, err = likedAlbums(ctx, r, userID)
+	case LikeTypeArtist:
+		items, err = likedArtists(ctx, r, userID)
+	default:
+		items, err = savedPlaylists(ctx, r, userID)
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch library")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, items, "Library fetched successfully")
+}
+
+// GetLibraryCounts returns how many items of each type the caller has saved.
+func GetLibraryCounts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	counts := map[string]int64{}
+	for path, entityType := range libraryTypes {
+		var n int64
+		var err error
+		if entityType == LikeTypePlaylist {
+			n, err = db.PlaylistFollowsCollection.CountDocuments(ctx, bson.M{"userid": userID})
+		} else {
+			n, err = db.LikesCollection.CountDocuments(ctx, bson.M{"userid": userID, "entityType": entityType})
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to count library")
+			return
+		}
+		counts[path] = n
+	}
+
+	respondJSON(w, http.StatusOK, counts, "Library counts fetched")
+}
+
+func likedAlbums(ctx context.Context, r *http.Request, userID string) ([]LikedAlbum, error) {
+	likes, err := likesPage(ctx, r, userID, LikeTypeAlbum)
+	if err != nil || len(likes) == 0 {
+		return []LikedAlbum{}, err
+	}
+	albums, err := utils.FindAndDecode[Album](ctx, db.AlbumsCollection,
+		bson.M{"albumid": bson.M{"$in": likedIDs(likes)}, "published": true})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Album, len(albums))
+	for _, a := range albums {
+		byID[a.AlbumID] = a
+	}
+
+	out := make([]LikedAlbum, 0, len(likes))
+	for _, l := range likes {
+		if a, ok := byID[l.EntityID]; ok {
+			out = append(out, LikedAlbum{Album: a, LikedAt: l.LikedAt})
+		}
+	}
+	return out, nil
+}
+
+func likedArtists(ctx context.Context, r *http.Request, userID string) ([]LikedArtist, error) {
+	likes, err := likesPage(ctx, r, userID, LikeTypeArtist)
+	if err != nil || len(likes) == 0 {
+		return []LikedArtist{}, err
+	}
+	artists, err := utils.FindAndDecode[models.Artist](ctx, db.ArtistsCollection,
+		bson.M{"artistid": bson.M{"$in": likedIDs(likes)}})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]models.Artist, len(artists))
+	for _, a := range artists {
+		byID[a.ArtistID] = a
+	}
+
+	out := make([]LikedArtist, 0, len(likes))
+	for _, l := range likes {
+		if a, ok := byID[l.EntityID]; ok {
+			out = append(out, LikedArtist{Artist: a, LikedAt: l.LikedAt})
+		}
+	}
+	return out, nil
+}
+
+// savedPlaylists pages through the caller's follows. Playlists that were
+// deleted or made private since are skipped, and only owners see who
+// collaborates on a playlist.
+func savedPlaylists(ctx context.Context, r *http.Request, userID string) ([]SavedPlaylist, error) {
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "followedAt", Value: -1}, {Key: "playlistid", Value: 1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	follows, err := utils.FindAndDecode[PlaylistFollow](ctx, db.PlaylistFollowsCollection, bson.M{"userid": userID}, opts)
+	if err != nil || len(follows) == 0 {
+		return []SavedPlaylist{}, err
+	}
+	ids := make([]string, len(follows))
+	for i, f := range follows {
+		ids[i] = f.PlaylistID
+	}
+
+	playlists, err := utils.FindAndDecode[Playlist](ctx, db.PlaylistsCollection, live(bson.M{"playlistid": bson.M{"$in": ids}}))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Playlist, len(playlists))
+	for _, p := range playlists {
+		byID[p.PlaylistID] = p
+	}
+
+	out := make([]SavedPlaylist, 0, len(follows))
+	for _, f := range follows {
+		if p, ok := byID[f.PlaylistID]; ok && canViewPlaylist(&p, userID) {
+			if p.UserID != userID {
+				p.Collaborators = nil
+			}
+			out = append(out, SavedPlaylist{Playlist: p, LikedAt: f.FollowedAt})
+		}
+	}
+	return out, nil
+}
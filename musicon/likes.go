@@ -0,0 +1,475 @@
+package musicon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/models"
+	"naevis/mq"
+	"naevis/rdx"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Entity types that can be liked or saved. Playlists are saved by following
+// them, so their saves live in PlaylistFollowsCollection.
+const (
+	LikeTypeSong     = "song"
+	LikeTypeAlbum    = "album"
+	LikeTypeArtist   = "artist"
+	LikeTypePlaylist = "playlist"
+)
+
+// maxLikeChecks caps how many IDs one CheckLikedSongs call may ask about.
+const maxLikeChecks = 500
+
+const (
+	// legacyImportBatch is how many legacy likes playlists are read at a time.
+	legacyImportBatch = 100
+	// legacyImportCursorKey holds the last legacy playlist ID a pass got
+	// past, so a restart resumes there instead of starting over.
+	legacyImportCursorKey = "likes:legacy:cursor"
+	legacyImportEvery     = time.Hour
+)
+
+var (
+	errLikeTargetNotFound = errors.New("like target not found")
+	errOwnPlaylist        = errors.New("cannot save own playlist")
+)
+
+// Like records that a user liked an entity. One document exists per user and
+// entity, so repeating a like is a no-op.
+type Like struct {
+	UserID     string    `json:"userid" bson:"userid"`
+	EntityType string    `json:"entityType" bson:"entityType"`
+	EntityID   string    `json:"entityid" bson:"entityid"`
+	LikedAt    time.Time `json:"likedAt" bson:"likedAt"`
+}
+
+// LikedSong is a song as returned by the liked-songs listing.
+type LikedSong struct {
+	Song
+	LikedAt time.Time `json:"likedAt"`
+}
+
+// likeTarget describes where a likeable entity lives and which of its
+// fields counts likes.
+type likeTarget struct {
+	collection *mongo.Collection
+	idField    string
+	counter    string
+}
+
+func likeTargetFor(entityType string) (likeTarget, bool) {
+	switch entityType {
+	case LikeTypeSong:
+		return likeTarget{db.SongsCollection, "songid", "likes"}, true
+	case LikeTypeAlbum:
+		return likeTarget{db.AlbumsCollection, "albumid", "likes"}, true
+	case LikeTypeArtist:
+		return likeTarget{db.ArtistsCollection, "artistid", "followers"}, true
+	case LikeTypePlaylist:
+		return likeTarget{db.PlaylistsCollection, "playlistid", "followers"}, true
+	}
+	return likeTarget{}, false
+}
+
+func likeFilter(userID, entityType, entityID string) bson.M {
+	return bson.M{"userid": userID, "entityType": entityType, "entityid": entityID}
+}
+
+// EnsureLikeIndexes creates the unique index that keeps one like per user
+// and entity. Without it, concurrent upserts of the same like can both
+// insert and count twice.
+func EnsureLikeIndexes(ctx context.Context) {
+	_, err := db.LikesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userid", Value: 1}, {Key: "entityType", Value: 1}, {Key: "entityid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Likes: failed to create unique index: %v", err)
+	}
+}
+
+// addLike stores a like and reports whether it is new. A concurrent insert
+// of the same like loses on the unique index and counts as not new.
+func addLike(ctx context.Context, userID, entityType, entityID string, at time.Time) (bool, error) {
+	res, err := db.LikesCollection.UpdateOne(ctx,
+		likeFilter(userID, entityType, entityID),
+		bson.M{"$setOnInsert": Like{UserID: userID, EntityType: entityType, EntityID: entityID, LikedAt: at}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+// removeLike deletes a like and reports whether one existed.
+func removeLike(ctx context.Context, userID, entityType, entityID string) (bool, error) {
+	res, err := db.LikesCollection.DeleteOne(ctx, likeFilter(userID, entityType, entityID))
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// bumpLikeCounter moves an entity's like counter, never below zero.
+func bumpLikeCounter(ctx context.Context, entityType, entityID string, delta int) error {
+	target, _ := likeTargetFor(entityType)
+	filter := bson.M{target.idField: entityID}
+	if delta < 0 {
+		filter[target.counter] = bson.M{"$gt": 0}
+	}
+	_, err := target.collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{target.counter: delta}})
+	return err
+}
+
+// checkLikable verifies that userID may like the entity: songs and albums
+// must be published, artists must exist, and playlists must be someone
+// else's and viewable.
+func checkLikable(ctx context.Context, userID, entityType, entityID string) error {
+	switch entityType {
+	case LikeTypeSong:
+		available, err := publishedSongIDs(ctx, []string{entityID})
+		if err != nil {
+			return err
+		}
+		if !available[entityID] {
+			return errLikeTargetNotFound
+		}
+		return nil
+
+	case LikeTypePlaylist:
+		var playlist Playlist
+		err := db.PlaylistsCollection.FindOne(ctx, live(bson.M{"playlistid": entityID})).Decode(&playlist)
+		if err == mongo.ErrNoDocuments || (err == nil && !canViewPlaylist(&playlist, userID)) {
+			return errLikeTargetNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if playlist.UserID == userID {
+			return errOwnPlaylist
+		}
+		return nil
+
+	default:
+		target, _ := likeTargetFor(entityType)
+		filter := bson.M{target.idField: entityID}
+		if entityType == LikeTypeAlbum {
+			filter["published"] = true
+		}
+		err := target.collection.FindOne(ctx, filter).Err()
+		if err == mongo.ErrNoDocuments {
+			return errLikeTargetNotFound
+		}
+		return err
+	}
+}
+
+// setLike likes or unlikes an entity for userID, keeping the entity's
+// counter in step and emitting an index event when anything changed.
+// Repeating a like or unlike is a no-op.
+func setLike(ctx context.Context, userID, entityType, entityID string, liked bool) error {
+	var changed bool
+	var err error
+	switch {
+	case liked:
+		if err := checkLikable(ctx, userID, entityType, entityID); err != nil {
+			return err
+		}
+		if entityType == LikeTypePlaylist {
+			changed, err = addFollow(ctx, userID, entityID)
+		} else {
+			changed, err = addLike(ctx, userID, entityType, entityID, time.Now())
+		}
+	case entityType == LikeTypePlaylist:
+		changed, err = removeFollow(ctx, userID, entityID)
+	default:
+		changed, err = removeLike(ctx, userID, entityType, entityID)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	delta, event := 1, "liked"
+	if !liked {
+		delta, event = -1, "unliked"
+	}
+	if err := bumpLikeCounter(ctx, entityType, entityID, delta); err != nil {
+		return err
+	}
+
+	// The counter on the entity changed, so downstream indexes need a refresh
+	mq.Emit(ctx, event, models.Index{
+		EntityType: entityType,
+		Method:     "PUT",
+		EntityId:   entityID,
+		ItemId:     userID,
+		ItemType:   "user",
+	})
+	return nil
+}
+
+// respondLikeError maps setLike errors onto responses.
+func respondLikeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errLikeTargetNotFound):
+		respondError(w, http.StatusNotFound, "Not found or unavailable")
+	case errors.Is(err, errOwnPlaylist):
+		respondError(w, http.StatusBadRequest, "Cannot save your own playlist")
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to update likes")
+	}
+}
+
+// legacyLikesID is the playlist the old like endpoint kept for a user.
+func legacyLikesID(userID string) string {
+	return fmt.Sprintf("likes_%s", userID)
+}
+
+// StartLegacyLikesImport moves the likes_<userid> playlists that the old
+// like endpoint maintained into LikesCollection in the background, making a
+// pass once an hour until ctx is cancelled. Playlists that fail to import,
+// and those in the trash, are left alone and picked up by a later pass.
+func StartLegacyLikesImport(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(legacyImportEvery)
+		defer ticker.Stop()
+		for {
+			importAllLegacyLikes(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// importAllLegacyLikes works through the legacy playlists in playlistid
+// order, starting after the stored cursor and advancing it after every
+// batch. A failing playlist is logged and skipped. The cursor is cleared
+// once the end is reached, so the next pass retries whatever was skipped.
+func importAllLegacyLikes(ctx context.Context) {
+	after, err := rdx.Conn.Get(ctx, legacyImportCursorKey).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("Likes: failed to read legacy import cursor: %v", err)
+		return
+	}
+
+	for ctx.Err() == nil {
+		opCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		legacy, err := utils.FindAndDecode[Playlist](opCtx, db.PlaylistsCollection,
+			live(bson.M{"playlistid": bson.M{"$regex": "^likes_", "$gt": after}}),
+			options.Find().SetSort(bson.D{{Key: "playlistid", Value: 1}}).SetLimit(legacyImportBatch))
+		cancel()
+		if err != nil {
+			log.Printf("Likes: failed to list legacy playlists: %v", err)
+			return
+		}
+		if len(legacy) == 0 {
+			if after != "" {
+				if err := rdx.Conn.Del(ctx, legacyImportCursorKey).Err(); err != nil {
+					log.Printf("Likes: failed to reset legacy import cursor: %v", err)
+				}
+			}
+			return
+		}
+
+		for i := range legacy {
+			if legacy[i].PlaylistID != legacyLikesID(legacy[i].UserID) {
+				continue
+			}
+			opCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err := importLegacyLikes(opCtx, &legacy[i])
+			cancel()
+			if err != nil {
+				log.Printf("Likes: failed to import %s: %v", legacy[i].PlaylistID, err)
+			}
+		}
+
+		after = legacy[len(legacy)-1].PlaylistID
+		if err := rdx.Conn.Set(ctx, legacyImportCursorKey, after, 0).Err(); err != nil {
+			log.Printf("Likes: failed to save legacy import cursor: %v", err)
+		}
+	}
+}
+
+// importLegacyLikes moves the songs of a legacy likes playlist into
+// LikesCollection and drops the playlist. Likes that already exist are
+// kept, so a repeated import neither duplicates them nor recounts them.
+func importLegacyLikes(ctx context.Context, legacy *Playlist) error {
+	userID, playlistID := legacy.UserID, legacy.PlaylistID
+	for _, e := range legacy.Songs {
+		at := e.AddedAt
+		if at.IsZero() {
+			at = legacy.CreatedAt
+		}
+		added, err := addLike(ctx, userID, LikeTypeSong, e.SongID, at)
+		if err != nil {
+			return err
+		}
+		if added {
+			if err := bumpLikeCounter(ctx, LikeTypeSong, e.SongID, 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := db.PlaylistsCollection.DeleteOne(ctx, bson.M{"playlistid": playlistID}); err != nil {
+		return err
+	}
+	if _, err := db.PlaylistHistoryCollection.DeleteMany(ctx, bson.M{"playlistid": playlistID}); err != nil {
+		return err
+	}
+	log.Printf("Imported %d legacy likes for user %s", len(legacy.Songs), userID)
+	return nil
+}
+
+// likesPage returns one page of userID's likes of entityType, most recent
+// first.
+func likesPage(ctx context.Context, r *http.Request, userID, entityType string) ([]Like, error) {
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "likedAt", Value: -1}, {Key: "entityid", Value: 1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	return utils.FindAndDecode[Like](ctx, db.LikesCollection, bson.M{"userid": userID, "entityType": entityType}, opts)
+}
+
+func likedIDs(likes []Like) []string {
+	ids := make([]string, len(likes))
+	for i, l := range likes {
+		ids[i] = l.EntityID
+	}
+	return ids
+}
+
+// --------------------------- Like Handlers ---------------------------
+
+// LikeSong adds a published song to the caller's likes.
+func LikeSong(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	songID := ps.ByName("songid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := setLike(ctx, userID, LikeTypeSong, songID, true); err != nil {
+		respondLikeError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"song_id": songID, "liked": true}, "Song added to liked songs")
+}
+
+// UnlikeSong removes a song from the caller's likes.
+func UnlikeSong(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	songID := ps.ByName("songid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := setLike(ctx, userID, LikeTypeSong, songID, false); err != nil {
+		respondLikeError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"song_id": songID, "liked": false}, "Song removed from liked songs")
+}
+
+// CheckLikedSongs reports, for each requested song ID, whether the caller
+// has liked it.
+func CheckLikedSongs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	var body struct {
+		SongIDs []string `json:"songids"`
+	}
+	if err := utils.ParseJSON(r, &body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON input")
+		return
+	}
+	if len(body.SongIDs) == 0 || len(body.SongIDs) > maxLikeChecks {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Provide 1-%d song IDs", maxLikeChecks))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	likes, err := utils.FindAndDecode[Like](ctx, db.LikesCollection,
+		bson.M{"userid": userID, "entityType": LikeTypeSong, "entityid": bson.M{"$in": body.SongIDs}},
+		options.Find().SetProjection(bson.M{"entityid": 1}))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check likes")
+		return
+	}
+
+	liked := make(map[string]bool, len(body.SongIDs))
+	for _, id := range body.SongIDs {
+		liked[id] = false
+	}
+	for _, l := range likes {
+		liked[l.EntityID] = true
+	}
+
+	respondJSON(w, http.StatusOK, liked, "Likes checked")
+}
+
+// GetUserLikes lists the caller's liked songs, most recently liked first.
+// Songs that have since been unpublished are left out of the page.
+func GetUserLikes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	liked, err := likedSongs(ctx, r, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch likes")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, liked, "Likes fetched successfully")
+}
+
+func likedSongs(ctx context.Context, r *http.Request, userID string) ([]LikedSong, error) {
+	likes, err := likesPage(ctx, r, userID, LikeTypeSong)
+	if err != nil {
+		return nil, err
+	}
+
+	songs, err := fetchSongsByIDs(ctx, likedIDs(likes), userID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Song, len(songs))
+	for _, s := range songs {
+		byID[s.SongID] = s
+	}
+
+	liked := make([]LikedSong, 0, len(likes))
+	for _, l := range likes {
+		if s, ok := byID[l.EntityID]; ok {
+			liked = append(liked, LikedSong{Song: s, LikedAt: l.LikedAt})
+		}
+	}
+	return liked, nil
+}
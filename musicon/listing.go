@@ -0,0 +1,350 @@
+package musicon
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// Sort keys accepted by the song, album and artist listings. Every sort
+// ends with the ID so that cursors have a unique position to resume from.
+// Albums and artists have no play counts of their own, so most_played
+// ranks them by likes and followers.
+var (
+	songSorts = map[string]bson.D{
+		"newest":      {{Key: "uploadedAt", Value: -1}, {Key: "songid", Value: -1}},
+		"most_played": {{Key: "plays", Value: -1}, {Key: "songid", Value: -1}},
+		"title":       {{Key: "title", Value: 1}, {Key: "songid", Value: 1}},
+	}
+	albumSorts = map[string]bson.D{
+		"newest":      {{Key: "releaseDate", Value: -1}, {Key: "albumid", Value: -1}},
+		"most_played": {{Key: "likes", Value: -1}, {Key: "albumid", Value: -1}},
+		"title":       {{Key: "title", Value: 1}, {Key: "albumid", Value: 1}},
+	}
+	artistSorts = map[string]bson.D{
+		"newest":      {{Key: "createdAt", Value: -1}, {Key: "artistid", Value: -1}},
+		"most_played": {{Key: "followers", Value: -1}, {Key: "artistid", Value: -1}},
+		"title":       {{Key: "name", Value: 1}, {Key: "artistid", Value: 1}},
+	}
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// listFilters are the filters shared by the catalog listings.
+type listFilters struct {
+	genre    string
+	language string
+	artistID string
+	year     int
+}
+
+func parseListFilters(r *http.Request) (listFilters, error) {
+	q := r.URL.Query()
+	f := listFilters{
+		genre:    q.Get("genre"),
+		language: q.Get("language"),
+		artistID: q.Get("artist"),
+	}
+	if y := q.Get("year"); y != "" {
+		year, err := strconv.Atoi(y)
+		if err != nil || year < 1000 || year > 9999 {
+			return f, errors.New("year must be a four-digit year")
+		}
+		f.year = year
+	}
+	return f, nil
+}
+
+// equalFold matches a field equal to value, ignoring case.
+func equalFold(value string) bson.M {
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(value) + "$", "$options": "i"}
+}
+
+// songFilter selects published songs passing f.
+func (f listFilters) songFilter() bson.M {
+	filter := bson.M{"published": true}
+	if f.genre != "" {
+		filter["genre"] = equalFold(f.genre)
+	}
+	if f.language != "" {
+		filter["language"] = equalFold(f.language)
+	}
+	if f.artistID != "" {
+		filter["artistid"] = f.artistID
+	}
+	if f.year != 0 {
+		filter["uploadedAt"] = bson.M{
+			"$gte": time.Date(f.year, 1, 1, 0, 0, 0, 0, time.UTC),
+			"$lt":  time.Date(f.year+1, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+	}
+	return filter
+}
+
+// albumFilter selects published albums passing f. Albums have no genre or
+// language of their own, so those match albums holding such a song.
+func (f listFilters) albumFilter(ctx context.Context) (bson.M, error) {
+	filter := bson.M{"published": true}
+	if f.artistID != "" {
+		filter["artistid"] = f.artistID
+	}
+	if f.year != 0 {
+		filter["releaseDate"] = bson.M{"$gte": fmt.Sprintf("%04d", f.year), "$lt": fmt.Sprintf("%04d", f.year+1)}
+	}
+	if f.genre != "" || f.language != "" {
+		songs := listFilters{genre: f.genre, language: f.language}
+		ids, err := db.SongsCollection.Distinct(ctx, "songid", songs.songFilter())
+		if err != nil {
+			return nil, err
+		}
+		filter["songs"] = bson.M{"$in": ids}
+	}
+	return filter, nil
+}
+
+// artistFilter selects artists passing f. Genre matches the artist's own
+// genres; language and year match artists with such a published song.
+func (f listFilters) artistFilter(ctx context.Context) (bson.M, error) {
+	filter := bson.M{}
+	if f.artistID != "" {
+		filter["artistid"] = f.artistID
+	}
+	if f.genre != "" {
+		filter["genres"] = equalFold(f.genre)
+	}
+	if f.language != "" || f.year != 0 {
+		songs := listFilters{language: f.language, year: f.year}
+		ids, err := db.SongsCollection.Distinct(ctx, "artistid", songs.songFilter())
+		if err != nil {
+			return nil, err
+		}
+		if f.artistID != "" {
+			filter["artistid"] = bson.M{"$eq": f.artistID, "$in": ids}
+		} else {
+			filter["artistid"] = bson.M{"$in": ids}
+		}
+	}
+	return filter, nil
+}
+
+// listCursor is the position after the last item of a page: its value of
+// the first sort field and its ID. It is sent to clients base64-encoded.
+type listCursor struct {
+	Field string        `bson:"f"`
+	Value bson.RawValue `bson:"v"`
+	ID    string        `bson:"id"`
+}
+
+func encodeListCursor(c listCursor) (string, error) {
+	raw, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeListCursor parses a cursor and checks it was issued for sort.
+func decodeListCursor(s string, sort bson.D) (*listCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c listCursor
+	if err := bson.Unmarshal(raw, &c); err != nil || c.Field != sort[0].Key || c.ID == "" {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// afterCursor matches documents sorting strictly after c under sort, which
+// is a field followed by an ID in the same direction. Missing values sort
+// lowest, so they follow every value when descending and precede every
+// value when ascending.
+func afterCursor(sort bson.D, c *listCursor) bson.M {
+	field, idField := sort[0].Key, sort[1].Key
+	desc := sort[0].Value == -1
+	op := "$gt"
+	if desc {
+		op = "$lt"
+	}
+
+	if c.Value.Type == bsontype.Null || c.Value.Type == bsontype.Undefined {
+		if desc {
+			return bson.M{field: nil, idField: bson.M{op: c.ID}}
+		}
+		return bson.M{"$or": bson.A{
+			bson.M{field: bson.M{"$ne": nil}},
+			bson.M{field: nil, idField: bson.M{op: c.ID}},
+		}}
+	}
+
+	clauses := bson.A{
+		bson.M{field: bson.M{op: c.Value}},
+		bson.M{field: c.Value, idField: bson.M{op: c.ID}},
+	}
+	if desc {
+		clauses = append(clauses, bson.M{field: nil})
+	}
+	return bson.M{"$or": clauses}
+}
+
+// listPage fetches up to limit documents matching filter in sort order,
+// resuming after the given cursor, or skipping skip documents when there is
+// none. It returns the cursor of the next page, or "" on the last one.
+func listPage[T any](ctx context.Context, col *mongo.Collection, filter bson.M, sort bson.D, after *listCursor, skip, limit int64) ([]T, string, error) {
+	opts := options.Find().SetSort(sort).SetLimit(limit + 1)
+	if after != nil {
+		filter = bson.M{"$and": bson.A{filter, afterCursor(sort, after)}}
+	} else if skip > 0 {
+		opts.SetSkip(skip)
+	}
+
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	items := make([]T, 0, limit)
+	var last bson.Raw
+	for cursor.Next(ctx) {
+		if int64(len(items)) == limit {
+			// There is at least one more document after this page
+			value := last.Lookup(sort[0].Key)
+			if value.Type == 0 {
+				value = bson.RawValue{Type: bsontype.Null}
+			}
+			id, _ := last.Lookup(sort[1].Key).StringValueOK()
+			next, err := encodeListCursor(listCursor{Field: sort[0].Key, Value: value, ID: id})
+			return items, next, err
+		}
+		var item T
+		if err := cursor.Decode(&item); err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+		last = append(bson.Raw(nil), cursor.Current...)
+	}
+	return items, "", cursor.Err()
+}
+
+// listParams reads the sort, cursor and page size shared by the listings.
+// Without a cursor the legacy ?page= is honoured.
+func listParams(r *http.Request, sorts map[string]bson.D) (sort bson.D, after *listCursor, skip, limit int64, err error) {
+	q := r.URL.Query()
+	if key := q.Get("sort"); key != "" {
+		if _, ok := sorts[key]; !ok {
+			return nil, nil, 0, 0, errors.New("sort must be newest, most_played or title")
+		}
+	}
+	sort = utils.ParseSort(q.Get("sort"), sorts["newest"], sorts)
+	skip, limit = utils.ParsePagination(r, defaultListLimit, maxListLimit)
+	if c := q.Get("cursor"); c != "" {
+		if after, err = decodeListCursor(c, sort); err != nil {
+			return nil, nil, 0, 0, errors.New("cursor is invalid or belongs to another sort")
+		}
+	}
+	return sort, after, skip, limit, nil
+}
+
+// wantsListPage reports whether a request to one of the listings that
+// predate cursors opted into the paged response by sending ?cursor=, left
+// empty for the first page. Without it they keep answering with a bare
+// array, as existing clients expect.
+func wantsListPage(r *http.Request) bool {
+	return r.URL.Query().Has("cursor")
+}
+
+func respondListPage[T any](w http.ResponseWriter, items []T, next string, limit int64, message string) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":      items,
+		"nextCursor": next,
+		"limit":      limit,
+	}, message)
+}
+
+// serveSongListing lists published songs. A non-empty artistID overrides
+// the ?artist= filter.
+func serveSongListing(w http.ResponseWriter, r *http.Request, artistID string) {
+	filters, err := parseListFilters(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if artistID != "" {
+		filters.artistID = artistID
+	}
+	sort, after, skip, limit, err := listParams(r, songSorts)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	songs, next, err := listPage[Song](ctx, db.SongsCollection, filters.songFilter(), sort, after, skip, limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch songs")
+		return
+	}
+	signStreamURLs(songs, utils.GetUserIDFromRequest(r))
+	respondListPage(w, songs, next, limit, "Songs fetched successfully")
+}
+
+// ListSongs lists published songs.
+//
+// Query parameters: genre, language, artist and year filter; sort is
+// newest (default), most_played or title; limit sizes the page and cursor,
+// taken from the previous page's nextCursor, continues the listing.
+func ListSongs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	serveSongListing(w, r, "")
+}
+
+// ListArtists lists artists, taking the same parameters as ListSongs.
+func ListArtists(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filters, err := parseListFilters(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sort, after, skip, limit, err := listParams(r, artistSorts)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, err := filters.artistFilter(ctx)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch artists")
+		return
+	}
+	artists, next, err := listPage[models.Artist](ctx, db.ArtistsCollection, filter, sort, after, skip, limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch artists")
+		return
+	}
+	respondListPage(w, artists, next, limit, "Artists fetched successfully")
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"naevis/db"
 	"naevis/utils"
 	"net/http"
@@ -20,8 +19,10 @@ import (
 
 // --------------------------- Helpers ---------------------------
 
-// fetchSongsByIDs retrieves songs by IDs, only published ones
-func fetchSongsByIDs(ctx context.Context, ids []string) ([]Song, error) {
+// fetchSongsByIDs retrieves songs by IDs, only published ones, in the order
+// the IDs were given. Repeated IDs yield repeated songs. Their AudioURL is
+// replaced by a signed stream URL for viewerID.
+func fetchSongsByIDs(ctx context.Context, ids []string, viewerID string) ([]Song, error) {
 	if len(ids) == 0 {
 		return []Song{}, nil
 	}
@@ -32,10 +33,22 @@ func fetchSongsByIDs(ctx context.Context, ids []string) ([]Song, error) {
 	}
 	defer cursor.Close(ctx)
 
-	var songs []Song
-	if err := cursor.All(ctx, &songs); err != nil {
+	var found []Song
+	if err := cursor.All(ctx, &found); err != nil {
 		return nil, err
 	}
+
+	byID := make(map[string]Song, len(found))
+	for _, s := range found {
+		byID[s.SongID] = s
+	}
+	songs := make([]Song, 0, len(ids))
+	for _, id := range ids {
+		if s, ok := byID[id]; ok {
+			songs = append(songs, s)
+		}
+	}
+	signStreamURLs(songs, viewerID)
 	return songs, nil
 }
 
@@ -56,11 +69,11 @@ func respondError(w http.ResponseWriter, status int, message string) {
 }
 
 func getPaginationParams(r *http.Request) (limit int64, page int64) {
-	limit = 20
+	limit = defaultListLimit
 	page = 1
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if parsed, err := strconv.ParseInt(l, 10, 64); err == nil && parsed > 0 {
-			limit = parsed
+			limit = min(parsed, maxListLimit)
 		}
 	}
 	if p := r.URL.Query().Get("page"); p != "" {
@@ -71,6 +84,33 @@ func getPaginationParams(r *http.Request) (limit int64, page int64) {
 	return
 }
 
+// pageBounds returns the slice bounds of a 1-based page of limit items out
+// of n. Pages past the end are empty; huge page numbers cannot overflow.
+func pageBounds(n, limit, page int64) (start, end int64) {
+	if limit <= 0 || page < 1 || page-1 > n/limit {
+		return n, n
+	}
+	start = (page - 1) * limit
+	return start, min(start+limit, n)
+}
+
+// newPlaylist builds an empty playlist owned by userID.
+func newPlaylist(userID, name, description, visibility string) Playlist {
+	return Playlist{
+		Name:        name,
+		Description: description,
+		UserID:      userID,
+		PlaylistID:  "pl_" + utils.GenerateRandomString(12),
+		Visibility:  visibility,
+		Songs:       []PlaylistEntry{},
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		Duration:    0,
+		TrackCount:  0,
+		Followers:   0,
+	}
+}
+
 // --------------------------- Playlist Handlers ---------------------------
 
 func GetUserPlaylists(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -80,21 +120,45 @@ func GetUserPlaylists(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		return
 	}
 
+	// ?include=owned|followed|all, defaulting to all
+	scope := strings.ToLower(r.URL.Query().Get("include"))
+	switch scope {
+	case "":
+		scope = LibraryAll
+	case LibraryOwned, LibraryFollowed, LibraryAll:
+	default:
+		respondError(w, http.StatusBadRequest, "include must be owned, followed or all")
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := db.PlaylistsCollection.Find(ctx, bson.M{"userid": userID})
+	filter, err := libraryFilter(ctx, userID, scope)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch followed playlists")
+		return
+	}
+
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	cursor, err := db.PlaylistsCollection.Find(ctx, filter, opts)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch playlists")
 		return
 	}
 	defer cursor.Close(ctx)
 
-	var playlists []Playlist
+	playlists := []Playlist{}
 	if err := cursor.All(ctx, &playlists); err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to decode playlists")
 		return
 	}
+	hideCollaborators(playlists, userID)
 
 	respondJSON(w, http.StatusOK, playlists, "Playlists fetched successfully")
 }
@@ -107,8 +171,10 @@ func CreatePlaylist(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	type Req struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
+		Name        string      `json:"name"`
+		Description string      `json:"description"`
+		Visibility  string      `json:"visibility"`
+		Rules       *SmartRules `json:"rules"`
 	}
 	var req Req
 	if err := utils.ParseJSON(r, &req); err != nil {
@@ -121,26 +187,38 @@ func CreatePlaylist(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		return
 	}
 
-	newPlaylist := Playlist{
-		Name:        req.Name,
-		Description: req.Description,
-		UserID:      userID,
-		PlaylistID:  "pl_" + utils.GenerateRandomString(12),
-		Songs:       []string{},
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-		Duration:    0,
+	if req.Rules != nil {
+		if err := req.Rules.validate(); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid rules: "+err.Error())
+			return
+		}
 	}
 
+	if req.Visibility == "" {
+		req.Visibility = VisibilityPrivate
+	} else if !validVisibility(req.Visibility) {
+		respondError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public")
+		return
+	}
+
+	playlist := newPlaylist(userID, req.Name, req.Description, req.Visibility)
+	playlist.Rules = req.Rules
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	if _, err := db.PlaylistsCollection.InsertOne(ctx, newPlaylist); err != nil {
+	if err := refreshPlaylistStats(ctx, &playlist); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to evaluate playlist rules")
+		return
+	}
+
+	if _, err := db.PlaylistsCollection.InsertOne(ctx, playlist); err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to create playlist")
 		return
 	}
+	recordPlaylistChange(ctx, playlist.PlaylistID, playlist.Revision, userID, OpCreate, nil, snapshotOf(&playlist))
 
-	respondJSON(w, http.StatusCreated, newPlaylist, "Playlist created successfully")
+	respondJSON(w, http.StatusCreated, playlist, "Playlist created successfully")
 }
 
 func DeletePlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -150,9 +228,20 @@ func DeletePlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	res := db.PlaylistsCollection.FindOneAndDelete(ctx, bson.M{"playlistid": playlistID, "userid": userID})
-	if res.Err() != nil {
-		if res.Err() == mongo.ErrNoDocuments {
+	// Soft delete: the playlist sits in the trash until RestorePlaylist or
+	// the background purger picks it up
+	now := time.Now()
+	var deleted Playlist
+	err := db.PlaylistsCollection.FindOneAndUpdate(ctx,
+		live(bson.M{"playlistid": playlistID, "userid": userID}),
+		bson.M{
+			"$set": bson.M{"deletedAt": now, "updatedAt": now},
+			"$inc": bson.M{"revision": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&deleted)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
 			respondError(w, http.StatusNotFound, "Playlist not found or unauthorized")
 		} else {
 			respondError(w, http.StatusInternalServerError, "Failed to delete playlist")
@@ -160,89 +249,67 @@ func DeletePlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{"playlist_id": playlistID}, "Playlist deleted successfully")
+	recordPlaylistChange(ctx, playlistID, deleted.Revision, userID, OpDelete, snapshotOf(&deleted), nil)
+
+	respondJSON(w, http.StatusOK, map[string]string{"playlist_id": playlistID}, "Playlist moved to trash")
 }
 
 func AddSongToPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	playlistID := ps.ByName("playlistid")
 	userID := utils.GetUserIDFromRequest(r)
 
-	var body struct {
-		SongID string `json:"songid"`
-	}
+	var body addSongsRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid JSON body")
 		return
 	}
 
-	if body.SongID == "" {
-		respondError(w, http.StatusBadRequest, "Missing song ID")
+	if body.isBulk() {
+		addSongsBulk(w, r, playlistID, userID, body)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	filter := bson.M{"playlistid": playlistID, "userid": userID}
-	update := bson.M{
-		"$addToSet": bson.M{"songs": body.SongID},
-		"$set":      bson.M{"updatedAt": time.Now()},
-	}
-
-	res, err := db.PlaylistsCollection.UpdateOne(ctx, filter, update)
-	if err != nil || res.MatchedCount == 0 {
-		respondError(w, http.StatusForbidden, "Playlist not found or unauthorized")
+	if body.SongID == "" {
+		respondError(w, http.StatusBadRequest, "Missing song ID")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{
-		"playlist_id": playlistID,
-		"song_id":     body.SongID,
-	}, "Song added to playlist")
-}
-
-func SetUserLikes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	userID := utils.GetUserIDFromRequest(r)
-	songID := ps.ByName("songid")
-	playlistID := fmt.Sprintf("likes_%s", userID)
-
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{
-		"playlistid": playlistID,
-		"userid":     userID,
+	available, err := publishedSongIDs(ctx, []string{body.SongID})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to verify song")
+		return
 	}
-
-	update := bson.M{
-		"$addToSet": bson.M{"songs": songID},
-		"$set": bson.M{
-			"updatedAt": time.Now(),
-			"name":      "Liked Songs",
-		},
-		"$setOnInsert": bson.M{
-			"createdAt":   time.Now(),
-			"description": "Auto-generated playlist for liked songs",
-			"public":      false,
-		},
+	if !available[body.SongID] {
+		respondError(w, http.StatusNotFound, "Song not found or unpublished")
+		return
 	}
 
-	opts := options.Update().SetUpsert(true)
-
-	res, err := db.PlaylistsCollection.UpdateOne(ctx, filter, update, opts)
+	entry := newPlaylistEntry(body.SongID, userID)
+	filter := editablePlaylistFilter(playlistID, userID)
+	p, err := updatePlaylist(ctx, filter, userID, OpAddSongs, func(p *Playlist) error {
+		songs, err := insertEntries(p.Songs, body.Position, entry)
+		if err != nil {
+			return err
+		}
+		p.Songs = songs
+		return nil
+	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Database error")
+		respondPlaylistWriteError(w, err)
 		return
 	}
 
-	if res.UpsertedCount > 0 {
-		log.Printf("Created new likes playlist for user %s", userID)
-	}
-
-	respondJSON(w, http.StatusOK, map[string]string{
+	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"playlist_id": playlistID,
-		"song_id":     songID,
-	}, "Song added to liked songs")
+		"song_id":     body.SongID,
+		"entry_id":    entry.EntryID,
+		"duration":    p.Duration,
+		"trackCount":  p.TrackCount,
+		"revision":    p.Revision,
+	}, "Song added to playlist")
 }
 
 func RemoveSongFromPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -253,11 +320,20 @@ func RemoveSongFromPlaylist(w http.ResponseWriter, r *http.Request, ps httproute
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{"playlistid": playlistID, "userid": userID}
-	update := bson.M{"$pull": bson.M{"songs": songID}, "$set": bson.M{"updatedAt": time.Now()}}
-	res, err := db.PlaylistsCollection.UpdateOne(ctx, filter, update)
-	if err != nil || res.MatchedCount == 0 {
-		respondError(w, http.StatusForbidden, "Playlist not found or unauthorized")
+	// Removes every occurrence of the song; use RemovePlaylistEntry to drop one.
+	filter := editablePlaylistFilter(playlistID, userID)
+	_, err := updatePlaylist(ctx, filter, userID, OpRemoveSongs, func(p *Playlist) error {
+		kept := make([]PlaylistEntry, 0, len(p.Songs))
+		for _, e := range p.Songs {
+			if e.SongID != songID {
+				kept = append(kept, e)
+			}
+		}
+		p.Songs = kept
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
 		return
 	}
 
@@ -272,6 +348,7 @@ func UpdatePlaylistInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		Name        string `json:"name"`
 		Description string `json:"description"`
 		CoverURL    string `json:"coverUrl"`
+		Visibility  string `json:"visibility"`
 	}
 	var req Req
 	if err := utils.ParseJSON(r, &req); err != nil {
@@ -284,19 +361,27 @@ func UpdatePlaylistInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		return
 	}
 
-	update := bson.M{"$set": bson.M{
-		"name":        req.Name,
-		"description": req.Description,
-		"coverUrl":    req.CoverURL,
-		"updatedAt":   time.Now(),
-	}}
+	if req.Visibility != "" && !validVisibility(req.Visibility) {
+		respondError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public")
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	res, err := db.PlaylistsCollection.UpdateOne(ctx, bson.M{"playlistid": playlistID, "userid": userID}, update)
-	if err != nil || res.MatchedCount == 0 {
-		respondError(w, http.StatusForbidden, "Playlist not found or unauthorized")
+	filter := bson.M{"playlistid": playlistID, "userid": userID}
+	_, err := updatePlaylist(ctx, filter, userID, OpUpdateInfo, func(p *Playlist) error {
+		p.Name = req.Name
+		p.Description = req.Description
+		p.CoverURL = req.CoverURL
+		// Visibility is left unchanged when omitted
+		if req.Visibility != "" {
+			p.Visibility = req.Visibility
+		}
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
 		return
 	}
 
@@ -305,28 +390,45 @@ func UpdatePlaylistInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 
 // --------------------------- Albums & Songs ---------------------------
 
+// GetAlbums lists published albums, taking the same filter, sort and
+// cursor parameters as ListSongs. It answers with a bare array unless the
+// caller opts into cursors; see wantsListPage.
 func GetAlbums(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filters, err := parseListFilters(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sort, after, skip, limit, err := listParams(r, albumSorts)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := db.AlbumsCollection.Find(ctx, bson.M{"published": true})
+	filter, err := filters.albumFilter(ctx)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch albums")
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var albums []Album
-	if err := cursor.All(ctx, &albums); err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to decode albums")
+	albums, next, err := listPage[Album](ctx, db.AlbumsCollection, filter, sort, after, skip, limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch albums")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, albums, "Albums fetched successfully")
+	if !wantsListPage(r) {
+		respondJSON(w, http.StatusOK, albums, "Albums fetched successfully")
+		return
+	}
+	respondListPage(w, albums, next, limit, "Albums fetched successfully")
 }
 
 func GetAlbumSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	albumID := ps.ByName("albumid")
+	userID := utils.GetUserIDFromRequest(r)
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
@@ -341,7 +443,7 @@ func GetAlbumSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
-	songs, err := fetchSongsByIDs(ctx, album.Songs)
+	songs, err := fetchSongsByIDs(ctx, album.Songs, userID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch songs")
 		return
@@ -352,11 +454,12 @@ func GetAlbumSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 
 func GetPlaylistSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	playlistID := ps.ByName("playlistid")
+	userID := utils.GetUserIDFromRequest(r)
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	var playlist Playlist
-	err := db.PlaylistsCollection.FindOne(ctx, bson.M{"playlistid": playlistID}).Decode(&playlist)
+	err := db.PlaylistsCollection.FindOne(ctx, live(bson.M{"playlistid": playlistID})).Decode(&playlist)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			respondJSON(w, http.StatusOK, []Song{}, "Playlist not found")
@@ -366,19 +469,38 @@ func GetPlaylistSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		return
 	}
 
-	songs, err := fetchSongsByIDs(ctx, playlist.Songs)
+	// Private playlists look exactly like missing ones to other callers
+	if !canViewPlaylist(&playlist, userID) {
+		respondJSON(w, http.StatusOK, []Song{}, "Playlist not found")
+		return
+	}
+
+	var tracks []PlaylistTrack
+	if playlist.Rules != nil {
+		tracks, err = smartPlaylistTracks(ctx, playlist.Rules, userID)
+	} else {
+		tracks, err = fetchPlaylistTracks(ctx, playlist.Songs, userID)
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch songs")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, songs, fmt.Sprintf("Songs for playlist %s fetched", playlistID))
+	respondJSON(w, http.StatusOK, tracks, fmt.Sprintf("Songs for playlist %s fetched", playlistID))
 }
 
 // --------------------------- Artist Songs ---------------------------
 
+// GetArtistsSongs lists an artist's published songs as a bare array, paged
+// with ?page= and ?limit=. Callers opting into cursors (see wantsListPage)
+// get the same parameters and response as ListSongs instead.
 func GetArtistsSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	artistID := ps.ByName("artistid")
+	if wantsListPage(r) {
+		serveSongListing(w, r, artistID)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
@@ -387,6 +509,9 @@ func GetArtistsSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 
 	pipeline := mongo.Pipeline{
 		{{Key: "$match", Value: bson.M{"artistid": artistID}}},
+		// Songs are stored either nested in an artist document's songs
+		// array or one per document; treat the latter as a list of one
+		{{Key: "$project", Value: bson.M{"songs": bson.M{"$ifNull": bson.A{"$songs", bson.A{"$$ROOT"}}}}}},
 		{{Key: "$unwind", Value: "$songs"}},
 		{{Key: "$match", Value: bson.M{"songs.published": true}}},
 		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$songs"}}},
@@ -406,6 +531,7 @@ func GetArtistsSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 		respondError(w, http.StatusInternalServerError, "Failed to decode songs")
 		return
 	}
+	signStreamURLs(songs, utils.GetUserIDFromRequest(r))
 
 	respondJSON(w, http.StatusOK, songs, fmt.Sprintf("Songs for artist %s fetched", artistID))
 }
@@ -431,6 +557,7 @@ func GetRecommendedSongs(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		respondError(w, http.StatusInternalServerError, "Failed to decode songs")
 		return
 	}
+	signStreamURLs(songs, utils.GetUserIDFromRequest(r))
 
 	respondJSON(w, http.StatusOK, songs, "Recommended songs fetched")
 }
@@ -458,67 +585,38 @@ func GetRecommendedAlbums(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	respondJSON(w, http.StatusOK, albums, "Recommended albums fetched")
 }
 
+// GetRecommendations ranks songs against the caller's taste profile, built
+// from their listening history, likes and playlists. Songs heard in the
+// last week are left out. Anonymous callers get the most played songs.
+// based_on optionally narrows the candidates.
 func GetRecommendations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	basedOn := strings.ToLower(r.URL.Query().Get("based_on"))
 
-	filter := bson.M{"published": true}
+	base := bson.M{}
 	switch basedOn {
 	case "recently_played":
-		filter["plays"] = bson.M{"$gt": 0}
+		base["plays"] = bson.M{"$gt": 0}
 	case "language_en":
-		filter["language"] = "en"
+		base["language"] = "en"
 	case "genre_pop":
-		filter["genre"] = "Pop"
+		base["genre"] = "Pop"
 	}
 
 	limit, page := getPaginationParams(r)
-	opts := options.Find().SetLimit(limit).SetSkip((page - 1) * limit)
-
-	cursor, err := db.SongsCollection.Find(ctx, filter, opts)
+	songs, err := recommendSongs(ctx, userID, base, limit, page)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch recommendations")
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var songs []Song
-	if err := cursor.All(ctx, &songs); err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to decode songs")
-		return
-	}
+	signStreamURLs(songs, userID)
 
 	respondJSON(w, http.StatusOK, songs, "Personalized recommendations fetched")
 }
 
-func GetUserLikes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	userID := utils.GetUserIDFromRequest(r)
-	if userID == "" {
-		respondError(w, http.StatusUnauthorized, "Unauthorized or missing user ID")
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	cursor, err := db.LikesCollection.Find(ctx, bson.M{"userid": userID})
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to fetch likes")
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var likes []Playlist
-	if err := cursor.All(ctx, &likes); err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to decode likes")
-		return
-	}
-
-	respondJSON(w, http.StatusOK, likes, "Likes fetched successfully")
-}
-
 // package musicon
 
 // import (
@@ -1,6 +1,9 @@
 package musicon
 
-import "time"
+import (
+	"naevis/media"
+	"time"
+)
 
 // --------------------------- Structs ---------------------------
 
@@ -13,19 +16,63 @@ type Album struct {
 	AlbumID     string   `json:"albumid" bson:"albumid"`
 	Songs       []string `json:"songs" bson:"songs"`
 	CoverURL    string   `json:"coverUrl,omitempty" bson:"coverUrl,omitempty"`
+	Likes       int      `json:"likes,omitempty" bson:"likes,omitempty"`
 }
 
 type Playlist struct {
-	Name          string    `json:"name" bson:"name"`
-	Description   string    `json:"description" bson:"description"`
-	UserID        string    `json:"userid" bson:"userid"`
-	PlaylistID    string    `json:"playlistid" bson:"playlistid"`
-	Songs         []string  `json:"songs" bson:"songs"`
-	CreatedAt     time.Time `json:"createdAt" bson:"createdAt"`
-	UpdatedAt     time.Time `json:"updatedAt" bson:"updatedAt"`
-	Duration      int       `json:"duration" bson:"duration"`
-	IsCompilation bool      `json:"isCompilation" bson:"isCompilation"`
-	Copyrights    string    `json:"copyrights" bson:"copyrights"`
+	Name          string          `json:"name" bson:"name"`
+	Description   string          `json:"description" bson:"description"`
+	UserID        string          `json:"userid" bson:"userid"`
+	PlaylistID    string          `json:"playlistid" bson:"playlistid"`
+	Visibility    string          `json:"visibility" bson:"visibility"`
+	CoverURL      string          `json:"coverUrl,omitempty" bson:"coverUrl,omitempty"`
+	Collaborators []Collaborator  `json:"collaborators,omitempty" bson:"collaborators,omitempty"`
+	Songs         []PlaylistEntry `json:"songs" bson:"songs"`
+	Rules         *SmartRules     `json:"rules,omitempty" bson:"rules,omitempty"`
+	Revision      int64           `json:"revision" bson:"revision"`
+	CreatedAt     time.Time       `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt" bson:"updatedAt"`
+	DeletedAt     *time.Time      `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	Duration      int             `json:"duration" bson:"duration"`
+	TrackCount    int             `json:"trackCount" bson:"trackCount"`
+	Followers     int             `json:"followers" bson:"followers"`
+	ForkedFrom    *ForkSource     `json:"forkedFrom,omitempty" bson:"forkedFrom,omitempty"`
+	IsCompilation bool            `json:"isCompilation" bson:"isCompilation"`
+	Copyrights    string          `json:"copyrights" bson:"copyrights"`
+}
+
+// PlaylistEntry is one ordered slot in a playlist. The same song may occur
+// more than once, so entries are addressed by EntryID rather than SongID.
+type PlaylistEntry struct {
+	EntryID string    `json:"entryid" bson:"entryid"`
+	SongID  string    `json:"songid" bson:"songid"`
+	AddedBy string    `json:"addedBy,omitempty" bson:"addedBy,omitempty"`
+	AddedAt time.Time `json:"addedAt" bson:"addedAt"`
+}
+
+// ForkSource identifies the playlist or album a playlist was copied from.
+type ForkSource struct {
+	Type string `json:"type" bson:"type"` // "playlist", "album" or "likes"
+	ID   string `json:"id" bson:"id"`
+	Name string `json:"name" bson:"name"`
+}
+
+// Collaborator is a user invited to view or edit someone else's playlist.
+type Collaborator struct {
+	UserID     string    `json:"userid" bson:"userid"`
+	Role       string    `json:"role" bson:"role"`
+	Status     string    `json:"status" bson:"status"`
+	InvitedBy  string    `json:"invitedBy" bson:"invitedBy"`
+	InvitedAt  time.Time `json:"invitedAt" bson:"invitedAt"`
+	AcceptedAt time.Time `json:"acceptedAt,omitempty" bson:"acceptedAt,omitempty"`
+}
+
+// PlaylistTrack is a resolved playlist entry as returned to clients.
+type PlaylistTrack struct {
+	Song
+	EntryID string    `json:"entryid"`
+	AddedBy string    `json:"addedBy,omitempty"`
+	AddedAt time.Time `json:"addedAt"`
 }
 
 type Song struct {
@@ -38,11 +85,42 @@ type Song struct {
 	AudioURL    string    `json:"audioUrl,omitempty" bson:"audioUrl,omitempty"`
 	Published   bool      `json:"published" bson:"published"`
 	Plays       int       `json:"plays,omitempty" bson:"plays,omitempty"`
+	Likes       int       `json:"likes,omitempty" bson:"likes,omitempty"`
 	UploadedAt  time.Time `json:"uploadedAt" bson:"uploadedAt"`
 	Poster      string    `bson:"poster,omitempty" json:"poster,omitempty"`
 	Language    string    `json:"language" bson:"language"`
 	AudioExtn   string    `json:"audioextn" bson:"audioextn"`
 	PosterExtn  string    `json:"posterextn" bson:"posterextn"`
+	HLS         *SongHLS  `json:"hls,omitempty" bson:"hls,omitempty"`
+}
+
+// SongHLS tracks a song's HLS packaging and the renditions it produced.
+type SongHLS struct {
+	Status     string               `json:"status" bson:"status"`
+	MasterURL  string               `json:"masterUrl,omitempty" bson:"-"`
+	Renditions []media.HLSRendition `json:"renditions,omitempty" bson:"renditions,omitempty"`
+	Error      string               `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt  *time.Time           `json:"-" bson:"startedAt,omitempty"`
+	PackagedAt *time.Time           `json:"packagedAt,omitempty" bson:"packagedAt,omitempty"`
+}
+
+// UploadSession tracks a resumable audio upload from creation until it
+// becomes a song. Chunks holds the indexes received so far, and Fields the
+// song details given up front.
+type UploadSession struct {
+	UploadID  string            `json:"uploadid" bson:"uploadid"`
+	UserID    string            `json:"-" bson:"userid"`
+	ArtistID  string            `json:"artistid" bson:"artistid"`
+	FileName  string            `json:"fileName" bson:"fileName"`
+	Size      int64             `json:"size" bson:"size"`
+	SHA256    string            `json:"sha256" bson:"sha256"`
+	ChunkSize int64             `json:"chunkSize" bson:"chunkSize"`
+	Chunks    []int             `json:"-" bson:"chunks"`
+	Fields    map[string]string `json:"-" bson:"fields,omitempty"`
+	Status    string            `json:"status" bson:"status"`
+	SongID    string            `json:"songid,omitempty" bson:"songid,omitempty"`
+	CreatedAt time.Time         `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt" bson:"expiresAt"`
 }
 
 // type Song struct {
@@ -0,0 +1,248 @@
+package musicon
+
+import (
+	"context"
+	"errors"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBulkSongs caps how many songs a single bulk add or remove may touch.
+const maxBulkSongs = 500
+
+var errSourceNotFound = errors.New("source not found")
+
+// addSongsRequest is the body of POST /playlists/:playlistid/songs. Exactly
+// one source is expected: a single songid, a songids list, an albumid or a
+// sourcePlaylistId. Position is the zero-based index to insert at; omitted
+// means append.
+type addSongsRequest struct {
+	SongID           string   `json:"songid"`
+	SongIDs          []string `json:"songids"`
+	AlbumID          string   `json:"albumid"`
+	SourcePlaylistID string   `json:"sourcePlaylistId"`
+	Position         *int     `json:"position"`
+	AllowDuplicates  bool     `json:"allowDuplicates"`
+}
+
+func (req addSongsRequest) isBulk() bool {
+	return len(req.SongIDs) > 0 || req.AlbumID != "" || req.SourcePlaylistID != ""
+}
+
+// BulkSongsResult reports the per-song outcome of a bulk playlist change.
+type BulkSongsResult struct {
+	PlaylistID     string   `json:"playlist_id"`
+	Added          []string `json:"added,omitempty"`
+	Removed        []string `json:"removed,omitempty"`
+	AlreadyPresent []string `json:"alreadyPresent,omitempty"`
+	NotPresent     []string `json:"notPresent,omitempty"`
+	Unavailable    []string `json:"unavailable,omitempty"`
+	Duration       int      `json:"duration"`
+	TrackCount     int      `json:"trackCount"`
+	Revision       int64    `json:"revision"`
+}
+
+// resolveSongSource expands the request's source into an ordered list of
+// song IDs.
+func resolveSongSource(ctx context.Context, req addSongsRequest, userID string) ([]string, error) {
+	switch {
+	case len(req.SongIDs) > 0:
+		return req.SongIDs, nil
+
+	case req.AlbumID != "":
+		var album Album
+		err := db.AlbumsCollection.FindOne(ctx, bson.M{"albumid": req.AlbumID, "published": true}).Decode(&album)
+		if err == mongo.ErrNoDocuments {
+			return nil, errSourceNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return album.Songs, nil
+
+	default:
+		var src Playlist
+		err := db.PlaylistsCollection.FindOne(ctx, live(bson.M{"playlistid": req.SourcePlaylistID})).Decode(&src)
+		if err == mongo.ErrNoDocuments || (err == nil && !canViewPlaylist(&src, userID)) {
+			return nil, errSourceNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return playlistSongIDs(ctx, &src)
+	}
+}
+
+// publishedSongIDs returns the subset of ids that exist and are published.
+func publishedSongIDs(ctx context.Context, ids []string) (map[string]bool, error) {
+	found := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	cursor, err := db.SongsCollection.Find(ctx,
+		bson.M{"songid": bson.M{"$in": ids}, "published": true},
+		options.Find().SetProjection(bson.M{"songid": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var s Song
+		if err := cursor.Decode(&s); err != nil {
+			return nil, err
+		}
+		found[s.SongID] = true
+	}
+	return found, cursor.Err()
+}
+
+// addSongsBulk adds every song from the request's source in one write. Songs
+// already in the playlist are skipped unless AllowDuplicates is set.
+func addSongsBulk(w http.ResponseWriter, r *http.Request, playlistID, userID string, req addSongsRequest) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	ids, err := resolveSongSource(ctx, req, userID)
+	if err != nil {
+		if errors.Is(err, errSourceNotFound) {
+			respondError(w, http.StatusNotFound, "Source album or playlist not found")
+		} else {
+			respondError(w, http.StatusInternalServerError, "Failed to resolve songs")
+		}
+		return
+	}
+	if len(ids) > maxBulkSongs {
+		respondError(w, http.StatusBadRequest, "Too many songs in one request")
+		return
+	}
+
+	available, err := publishedSongIDs(ctx, ids)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to verify songs")
+		return
+	}
+
+	result := BulkSongsResult{PlaylistID: playlistID}
+	filter := editablePlaylistFilter(playlistID, userID)
+	p, err := updatePlaylist(ctx, filter, userID, OpAddSongs, func(p *Playlist) error {
+		// Reset on every attempt; a lost race re-runs this closure.
+		result.Added, result.AlreadyPresent, result.Unavailable = nil, nil, nil
+
+		present := make(map[string]bool, len(p.Songs))
+		for _, e := range p.Songs {
+			present[e.SongID] = true
+		}
+
+		var entries []PlaylistEntry
+		for _, id := range ids {
+			switch {
+			case !available[id]:
+				result.Unavailable = append(result.Unavailable, id)
+			case present[id] && !req.AllowDuplicates:
+				result.AlreadyPresent = append(result.AlreadyPresent, id)
+			default:
+				entries = append(entries, newPlaylistEntry(id, userID))
+				result.Added = append(result.Added, id)
+				present[id] = true
+			}
+		}
+		if len(entries) == 0 {
+			return errNoChange
+		}
+
+		songs, err := insertEntries(p.Songs, req.Position, entries...)
+		if err != nil {
+			return err
+		}
+		p.Songs = songs
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	result.Duration, result.TrackCount, result.Revision = p.Duration, p.TrackCount, p.Revision
+	respondJSON(w, http.StatusOK, result, "Songs added to playlist")
+}
+
+// RemoveSongsFromPlaylist removes every occurrence of each listed song in
+// one write.
+func RemoveSongsFromPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	var body struct {
+		SongIDs []string `json:"songids"`
+	}
+	if err := utils.ParseJSON(r, &body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON input")
+		return
+	}
+	if len(body.SongIDs) == 0 {
+		respondError(w, http.StatusBadRequest, "Missing song IDs")
+		return
+	}
+	if len(body.SongIDs) > maxBulkSongs {
+		respondError(w, http.StatusBadRequest, "Too many songs in one request")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	result := BulkSongsResult{PlaylistID: playlistID}
+	filter := editablePlaylistFilter(playlistID, userID)
+	p, err := updatePlaylist(ctx, filter, userID, OpRemoveSongs, func(p *Playlist) error {
+		result.Removed, result.NotPresent = nil, nil
+
+		drop := make(map[string]bool, len(body.SongIDs))
+		for _, id := range body.SongIDs {
+			drop[id] = true
+		}
+
+		hit := make(map[string]bool)
+		kept := make([]PlaylistEntry, 0, len(p.Songs))
+		for _, e := range p.Songs {
+			if drop[e.SongID] {
+				hit[e.SongID] = true
+				continue
+			}
+			kept = append(kept, e)
+		}
+
+		seen := make(map[string]bool, len(body.SongIDs))
+		for _, id := range body.SongIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if hit[id] {
+				result.Removed = append(result.Removed, id)
+			} else {
+				result.NotPresent = append(result.NotPresent, id)
+			}
+		}
+		if len(kept) == len(p.Songs) {
+			return errNoChange
+		}
+		p.Songs = kept
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	result.Duration, result.TrackCount, result.Revision = p.Duration, p.TrackCount, p.Revision
+	respondJSON(w, http.StatusOK, result, "Songs removed from playlist")
+}
@@ -0,0 +1,304 @@
+package musicon
+
+import (
+	"context"
+	"errors"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errEntryNotFound    = errors.New("playlist entry not found")
+	errBadPosition      = errors.New("position out of range")
+	errPlaylistConflict = errors.New("playlist was modified concurrently")
+
+	// errNoChange lets a mutate callback skip the write when it has nothing
+	// to do; updatePlaylist then returns the playlist as loaded.
+	errNoChange = errors.New("no change")
+)
+
+// maxPlaylistWriteAttempts bounds the optimistic-concurrency retry loop.
+const maxPlaylistWriteAttempts = 3
+
+// UnmarshalBSONValue accepts both entry documents and the legacy plain
+// song-ID strings written before playlists were ordered. Legacy playlists
+// could not hold duplicates, so the song ID doubles as a stable entry ID
+// until the playlist is next rewritten.
+func (e *PlaylistEntry) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	if songID, ok := raw.StringValueOK(); ok {
+		*e = PlaylistEntry{EntryID: songID, SongID: songID}
+		return nil
+	}
+
+	type plain PlaylistEntry
+	var p plain
+	if err := raw.Unmarshal(&p); err != nil {
+		return err
+	}
+	*e = PlaylistEntry(p)
+	return nil
+}
+
+func newPlaylistEntry(songID, addedBy string) PlaylistEntry {
+	return PlaylistEntry{
+		EntryID: "pe_" + utils.GenerateRandomString(12),
+		SongID:  songID,
+		AddedBy: addedBy,
+		AddedAt: time.Now(),
+	}
+}
+
+// entrySongIDs returns the song IDs of entries in playlist order.
+func entrySongIDs(entries []PlaylistEntry) []string {
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.SongID
+	}
+	return ids
+}
+
+func findEntry(entries []PlaylistEntry, entryID string) int {
+	for i, e := range entries {
+		if e.EntryID == entryID {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertEntries places items at pos, or appends them when pos is nil.
+func insertEntries(entries []PlaylistEntry, pos *int, items ...PlaylistEntry) ([]PlaylistEntry, error) {
+	if pos == nil {
+		return append(entries, items...), nil
+	}
+	if *pos < 0 || *pos > len(entries) {
+		return nil, errBadPosition
+	}
+	out := make([]PlaylistEntry, 0, len(entries)+len(items))
+	out = append(out, entries[:*pos]...)
+	out = append(out, items...)
+	return append(out, entries[*pos:]...), nil
+}
+
+// moveEntry moves the entry with entryID so that it ends up at index to.
+func moveEntry(entries []PlaylistEntry, entryID string, to int) ([]PlaylistEntry, error) {
+	from := findEntry(entries, entryID)
+	if from < 0 {
+		return nil, errEntryNotFound
+	}
+	if to < 0 || to >= len(entries) {
+		return nil, errBadPosition
+	}
+	moved := entries[from]
+	out := make([]PlaylistEntry, 0, len(entries))
+	out = append(out, entries[:from]...)
+	out = append(out, entries[from+1:]...)
+	return insertEntries(out, &to, moved)
+}
+
+func removeEntry(entries []PlaylistEntry, entryID string) ([]PlaylistEntry, error) {
+	i := findEntry(entries, entryID)
+	if i < 0 {
+		return nil, errEntryNotFound
+	}
+	out := make([]PlaylistEntry, 0, len(entries)-1)
+	out = append(out, entries[:i]...)
+	return append(out, entries[i+1:]...), nil
+}
+
+// revisionMatch matches a stored revision, treating a missing field as 0 so
+// documents written before revisions existed can still be updated.
+func revisionMatch(rev int64) interface{} {
+	if rev == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return rev
+}
+
+// updatePlaylist loads the playlist matching filter, lets mutate edit it in
+// memory and writes the editable state back only if no other writer bumped
+// the revision in between. Lost races are retried a few times. Duration and
+// TrackCount are recomputed on every write, and each successful write is
+// appended to the playlist history as op performed by actor.
+func updatePlaylist(ctx context.Context, filter bson.M, actor, op string, mutate func(p *Playlist) error) (*Playlist, error) {
+	for attempt := 0; attempt < maxPlaylistWriteAttempts; attempt++ {
+		var p Playlist
+		if err := db.PlaylistsCollection.FindOne(ctx, live(filter)).Decode(&p); err != nil {
+			return nil, err
+		}
+		if p.Songs == nil {
+			p.Songs = []PlaylistEntry{}
+		}
+		before := snapshotOf(&p)
+
+		if p.Rules != nil && isSongEdit(op) {
+			return nil, errSmartPlaylist
+		}
+		if err := mutate(&p); err != nil {
+			if errors.Is(err, errNoChange) {
+				return &p, nil
+			}
+			return nil, err
+		}
+
+		if err := refreshPlaylistStats(ctx, &p); err != nil {
+			return nil, err
+		}
+
+		guard := live(bson.M{"playlistid": p.PlaylistID, "revision": revisionMatch(p.Revision)})
+		p.Revision++
+		p.UpdatedAt = time.Now()
+		update := bson.M{"$set": bson.M{
+			"name":        p.Name,
+			"description": p.Description,
+			"coverUrl":    p.CoverURL,
+			"visibility":  p.Visibility,
+			"songs":       p.Songs,
+			"duration":    p.Duration,
+			"trackCount":  p.TrackCount,
+			"revision":    p.Revision,
+			"updatedAt":   p.UpdatedAt,
+		}}
+		if p.Rules != nil {
+			update["$set"].(bson.M)["rules"] = p.Rules
+		} else {
+			update["$unset"] = bson.M{"rules": ""}
+		}
+
+		res, err := db.PlaylistsCollection.UpdateOne(ctx, guard, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 1 {
+			recordPlaylistChange(ctx, p.PlaylistID, p.Revision, actor, op, before, snapshotOf(&p))
+			return &p, nil
+		}
+	}
+	return nil, errPlaylistConflict
+}
+
+// respondPlaylistWriteError maps updatePlaylist errors onto responses.
+func respondPlaylistWriteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		respondError(w, http.StatusForbidden, "Playlist not found or unauthorized")
+	case errors.Is(err, errEntryNotFound):
+		respondError(w, http.StatusNotFound, "Playlist entry not found")
+	case errors.Is(err, errBadPosition):
+		respondError(w, http.StatusBadRequest, "Position out of range")
+	case errors.Is(err, errSmartPlaylist):
+		respondError(w, http.StatusConflict, "Smart playlists are defined by rules; edit the rules instead")
+	case errors.Is(err, errPlaylistConflict):
+		respondError(w, http.StatusConflict, "Playlist was modified concurrently, please retry")
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to update playlist")
+	}
+}
+
+// fetchPlaylistTracks resolves entries to songs, keeping playlist order and
+// duplicates. Entries whose song is missing or unpublished are skipped.
+func fetchPlaylistTracks(ctx context.Context, entries []PlaylistEntry, viewerID string) ([]PlaylistTrack, error) {
+	songs, err := fetchSongsByIDs(ctx, entrySongIDs(entries), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Song, len(songs))
+	for _, s := range songs {
+		byID[s.SongID] = s
+	}
+
+	tracks := make([]PlaylistTrack, 0, len(entries))
+	for _, e := range entries {
+		song, ok := byID[e.SongID]
+		if !ok {
+			continue
+		}
+		tracks = append(tracks, PlaylistTrack{Song: song, EntryID: e.EntryID, AddedBy: e.AddedBy, AddedAt: e.AddedAt})
+	}
+	return tracks, nil
+}
+
+// --------------------------- Entry Handlers ---------------------------
+
+// MovePlaylistEntry moves one entry to a new zero-based position.
+func MovePlaylistEntry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+	entryID := ps.ByName("entryid")
+
+	var body struct {
+		Position *int `json:"position"`
+	}
+	if err := utils.ParseJSON(r, &body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON input")
+		return
+	}
+	if body.Position == nil {
+		respondError(w, http.StatusBadRequest, "Missing position")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := editablePlaylistFilter(playlistID, userID)
+	p, err := updatePlaylist(ctx, filter, userID, OpMoveEntry, func(p *Playlist) error {
+		songs, err := moveEntry(p.Songs, entryID, *body.Position)
+		if err != nil {
+			return err
+		}
+		p.Songs = songs
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"playlist_id": playlistID,
+		"entry_id":    entryID,
+		"position":    *body.Position,
+		"revision":    p.Revision,
+	}, "Playlist entry moved")
+}
+
+// RemovePlaylistEntry removes a single occurrence of a song from a playlist.
+func RemovePlaylistEntry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+	entryID := ps.ByName("entryid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := editablePlaylistFilter(playlistID, userID)
+	p, err := updatePlaylist(ctx, filter, userID, OpRemoveSongs, func(p *Playlist) error {
+		songs, err := removeEntry(p.Songs, entryID)
+		if err != nil {
+			return err
+		}
+		p.Songs = songs
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"playlist_id": playlistID,
+		"entry_id":    entryID,
+		"duration":    p.Duration,
+		"trackCount":  p.TrackCount,
+		"revision":    p.Revision,
+	}, "Playlist entry removed")
+}
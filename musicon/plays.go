@@ -0,0 +1,254 @@
+package musicon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/rdx"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Play report events.
+const (
+	PlayStarted   = "started"
+	PlayCompleted = "completed"
+)
+
+const (
+	// defaultPlayRepeatWindow applies when PLAY_REPEAT_WINDOW is unset.
+	defaultPlayRepeatWindow = 30 * time.Second
+	// maxListenSeconds bounds listened time for songs whose duration
+	// cannot be parsed.
+	maxListenSeconds = 24 * 60 * 60
+)
+
+// Play is one entry in a user's listening history.
+type Play struct {
+	PlayID          string     `json:"playid" bson:"playid"`
+	UserID          string     `json:"userid" bson:"userid"`
+	SongID          string     `json:"songid" bson:"songid"`
+	StartedAt       time.Time  `json:"startedAt" bson:"startedAt"`
+	CompletedAt     *time.Time `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	ListenedSeconds int        `json:"listenedSeconds" bson:"listenedSeconds"`
+}
+
+// PlayedSong is a history entry as returned by the recently played listing.
+type PlayedSong struct {
+	Song
+	PlayID          string     `json:"playid"`
+	PlayedAt        time.Time  `json:"playedAt"`
+	CompletedAt     *time.Time `json:"completedAt,omitempty"`
+	ListenedSeconds int        `json:"listenedSeconds"`
+}
+
+// playRepeatWindow reads PLAY_REPEAT_WINDOW as a Go duration such as "30s".
+// Starts of the same song by the same user inside the window are not
+// counted again.
+func playRepeatWindow() time.Duration {
+	if v := os.Getenv("PLAY_REPEAT_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("Invalid PLAY_REPEAT_WINDOW %q, using %s", v, defaultPlayRepeatWindow)
+	}
+	return defaultPlayRepeatWindow
+}
+
+// claimPlay reports whether a new start of songID by userID should count.
+// A Redis key per user and song makes the check atomic across instances;
+// if Redis is unavailable the recent history is consulted instead.
+func claimPlay(ctx context.Context, userID, songID string, window time.Duration) (bool, error) {
+	if window == 0 {
+		return true, nil
+	}
+	ok, err := rdx.RdxSetNX(fmt.Sprintf("play:%s:%s", userID, songID), "1", window)
+	if err == nil {
+		return ok, nil
+	}
+	log.Printf("Play repeat check falling back to history: %v", err)
+
+	err = db.ListeningHistoryCollection.FindOne(ctx, bson.M{
+		"userid":    userID,
+		"songid":    songID,
+		"startedAt": bson.M{"$gt": time.Now().Add(-window)},
+	}).Err()
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	return false, err
+}
+
+// listenCap is the most listened time accepted for song.
+func listenCap(song Song) int {
+	if secs, err := parseSongDuration(song.Duration); err == nil && secs > 0 {
+		return secs
+	}
+	return maxListenSeconds
+}
+
+// ReportPlay records that the caller started or finished playing a song.
+//
+// A "started" report adds a history entry and increments Song.Plays, unless
+// the same user started the same song within the repeat window, in which
+// case it is acknowledged but not counted. A "completed" report sets the
+// listened time on the entry named by playid.
+func ReportPlay(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	songID := ps.ByName("songid")
+
+	var body struct {
+		Event           string `json:"event"`
+		PlayID          string `json:"playid"`
+		ListenedSeconds int    `json:"listenedSeconds"`
+	}
+	if err := utils.ParseJSON(r, &body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON input")
+		return
+	}
+	if body.ListenedSeconds < 0 {
+		respondError(w, http.StatusBadRequest, "listenedSeconds must not be negative")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var song Song
+	err := db.SongsCollection.FindOne(ctx, bson.M{"songid": songID, "published": true},
+		options.FindOne().SetProjection(bson.M{"songid": 1, "duration": 1})).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found or unpublished")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to verify song")
+		return
+	}
+	listened := min(body.ListenedSeconds, listenCap(song))
+
+	switch body.Event {
+	case PlayStarted:
+		counted, err := claimPlay(ctx, userID, songID, playRepeatWindow())
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to record play")
+			return
+		}
+		if !counted {
+			respondJSON(w, http.StatusOK, map[string]interface{}{"song_id": songID, "counted": false}, "Repeat play ignored")
+			return
+		}
+
+		play := Play{
+			PlayID:          "pp_" + utils.GenerateRandomString(12),
+			UserID:          userID,
+			SongID:          songID,
+			StartedAt:       time.Now(),
+			ListenedSeconds: listened,
+		}
+		if _, err := db.ListeningHistoryCollection.InsertOne(ctx, play); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to record play")
+			return
+		}
+		if _, err := db.SongsCollection.UpdateOne(ctx, bson.M{"songid": songID}, bson.M{"$inc": bson.M{"plays": 1}}); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to update play count")
+			return
+		}
+
+		respondJSON(w, http.StatusCreated, map[string]interface{}{
+			"song_id": songID,
+			"playid":  play.PlayID,
+			"counted": true,
+		}, "Play recorded")
+
+	case PlayCompleted:
+		if body.PlayID == "" {
+			respondError(w, http.StatusBadRequest, "Missing playid")
+			return
+		}
+		// Listened time only grows, so a late or repeated report cannot
+		// shorten it
+		now := time.Now()
+		res, err := db.ListeningHistoryCollection.UpdateOne(ctx,
+			bson.M{"playid": body.PlayID, "userid": userID, "songid": songID},
+			bson.M{
+				"$max": bson.M{"listenedSeconds": listened},
+				"$set": bson.M{"completedAt": now},
+			},
+		)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to record play")
+			return
+		}
+		if res.MatchedCount == 0 {
+			respondError(w, http.StatusNotFound, "Play not found")
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"song_id": songID,
+			"playid":  body.PlayID,
+		}, "Play completed")
+
+	default:
+		respondError(w, http.StatusBadRequest, "Event must be started or completed")
+	}
+}
+
+// GetRecentlyPlayed lists the caller's listening history, newest first.
+// Plays of songs that have since been unpublished are left out of the page.
+func GetRecentlyPlayed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "startedAt", Value: -1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	plays, err := utils.FindAndDecode[Play](ctx, db.ListeningHistoryCollection, bson.M{"userid": userID}, opts)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch listening history")
+		return
+	}
+
+	ids := make([]string, len(plays))
+	for i, p := range plays {
+		ids[i] = p.SongID
+	}
+	songs, err := fetchSongsByIDs(ctx, ids, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch songs")
+		return
+	}
+	byID := make(map[string]Song, len(songs))
+	for _, s := range songs {
+		byID[s.SongID] = s
+	}
+
+	history := make([]PlayedSong, 0, len(plays))
+	for _, p := range plays {
+		if s, ok := byID[p.SongID]; ok {
+			history = append(history, PlayedSong{
+				Song:            s,
+				PlayID:          p.PlayID,
+				PlayedAt:        p.StartedAt,
+				CompletedAt:     p.CompletedAt,
+				ListenedSeconds: p.ListenedSeconds,
+			})
+		}
+	}
+
+	respondJSON(w, http.StatusOK, history, "Recently played fetched successfully")
+}
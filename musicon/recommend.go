@@ -0,0 +1,250 @@
+package musicon
+
+import (
+	"context"
+	"math"
+	"naevis/db"
+	"naevis/utils"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// recentlyHeardWindow is how long a played song stays out of
+	// recommendations.
+	recentlyHeardWindow = 7 * 24 * time.Hour
+	// tasteHistoryWindow bounds how far back plays shape the taste profile.
+	tasteHistoryWindow = 90 * 24 * time.Hour
+
+	maxTastePlays     = 200
+	maxTasteLikes     = 200
+	maxTastePlaylists = 50
+	maxTasteSeeds     = 1000
+	maxCandidates     = 1000
+
+	topGenres    = 10
+	topArtists   = 20
+	topLanguages = 5
+)
+
+// Weights of each signal when building a taste profile, and of each
+// profile dimension when scoring a candidate.
+const (
+	playWeight      = 1.0
+	completedWeight = 1.5
+	likeWeight      = 3.0
+	playlistWeight  = 2.0
+	followWeight    = 3.0
+
+	genreScore      = 3.0
+	artistScore     = 2.0
+	languageScore   = 1.0
+	popularityScore = 0.5
+)
+
+// tasteProfile summarises what a user listens to. Weights are normalised
+// to 0..1 per dimension.
+type tasteProfile struct {
+	genres    map[string]float64
+	artists   map[string]float64
+	languages map[string]float64
+	heard     []string
+}
+
+func (t *tasteProfile) empty() bool {
+	return len(t.genres) == 0 && len(t.artists) == 0 && len(t.languages) == 0
+}
+
+// buildTasteProfile weighs the genres, artists and languages of the songs
+// userID recently played, liked or put in their playlists, plus the
+// artists they follow.
+func buildTasteProfile(ctx context.Context, userID string) (*tasteProfile, error) {
+	now := time.Now()
+	profile := &tasteProfile{
+		genres:    map[string]float64{},
+		artists:   map[string]float64{},
+		languages: map[string]float64{},
+	}
+	seeds := map[string]float64{}
+
+	plays, err := utils.FindAndDecode[Play](ctx, db.ListeningHistoryCollection,
+		bson.M{"userid": userID, "startedAt": bson.M{"$gte": now.Add(-tasteHistoryWindow)}},
+		options.Find().SetSort(bson.D{{Key: "startedAt", Value: -1}}).SetLimit(maxTastePlays))
+	if err != nil {
+		return nil, err
+	}
+	heard := map[string]bool{}
+	for _, p := range plays {
+		if p.CompletedAt != nil {
+			seeds[p.SongID] += completedWeight
+		} else {
+			seeds[p.SongID] += playWeight
+		}
+		if p.StartedAt.After(now.Add(-recentlyHeardWindow)) && !heard[p.SongID] {
+			heard[p.SongID] = true
+			profile.heard = append(profile.heard, p.SongID)
+		}
+	}
+
+	likes, err := utils.FindAndDecode[Like](ctx, db.LikesCollection,
+		bson.M{"userid": userID, "entityType": bson.M{"$in": bson.A{LikeTypeSong, LikeTypeArtist}}},
+		options.Find().SetSort(bson.D{{Key: "likedAt", Value: -1}}).SetLimit(maxTasteLikes))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range likes {
+		if l.EntityType == LikeTypeArtist {
+			profile.artists[l.EntityID] += followWeight
+		} else {
+			seeds[l.EntityID] += likeWeight
+		}
+	}
+
+	playlists, err := utils.FindAndDecode[Playlist](ctx, db.PlaylistsCollection,
+		live(bson.M{"userid": userID}),
+		options.Find().
+			SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+			SetLimit(maxTastePlaylists).
+			SetProjection(bson.M{"songs": 1}))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range playlists {
+		for _, e := range p.Songs {
+			if len(seeds) >= maxTasteSeeds {
+				break
+			}
+			seeds[e.SongID] += playlistWeight
+		}
+	}
+
+	if len(seeds) > 0 {
+		ids := make([]string, 0, len(seeds))
+		for id := range seeds {
+			ids = append(ids, id)
+		}
+		songs, err := utils.FindAndDecode[Song](ctx, db.SongsCollection,
+			bson.M{"songid": bson.M{"$in": ids}},
+			options.Find().SetProjection(bson.M{"songid": 1, "genre": 1, "artistid": 1, "language": 1}))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range songs {
+			weight := seeds[s.SongID]
+			if s.Genre != "" {
+				profile.genres[s.Genre] += weight
+			}
+			if s.ArtistID != "" {
+				profile.artists[s.ArtistID] += weight
+			}
+			if s.Language != "" {
+				profile.languages[s.Language] += weight
+			}
+		}
+	}
+
+	normalise(profile.genres)
+	normalise(profile.artists)
+	normalise(profile.languages)
+	return profile, nil
+}
+
+// normalise scales weights so the largest is 1.
+func normalise(weights map[string]float64) {
+	top := 0.0
+	for _, w := range weights {
+		top = math.Max(top, w)
+	}
+	if top == 0 {
+		return
+	}
+	for k, w := range weights {
+		weights[k] = w / top
+	}
+}
+
+// topKeys returns up to n keys with the highest weights.
+func topKeys(weights map[string]float64, n int) []string {
+	keys := make([]string, 0, len(weights))
+	for k := range weights {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if weights[keys[i]] != weights[keys[j]] {
+			return weights[keys[i]] > weights[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// recommendSongs returns one page of recommendations for userID. base
+// narrows the candidates, for example to a genre. Anonymous users and users
+// without any listening signals get the most played songs instead.
+func recommendSongs(ctx context.Context, userID string, base bson.M, limit, page int64) ([]Song, error) {
+	var profile *tasteProfile
+	if userID != "" {
+		var err error
+		if profile, err = buildTasteProfile(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := bson.M{"published": true}
+	for k, v := range base {
+		filter[k] = v
+	}
+	if profile != nil && len(profile.heard) > 0 {
+		filter["songid"] = bson.M{"$nin": profile.heard}
+	}
+
+	if profile == nil || profile.empty() {
+		opts := options.Find().
+			SetSort(bson.D{{Key: "plays", Value: -1}, {Key: "likes", Value: -1}, {Key: "songid", Value: 1}}).
+			SetLimit(limit).
+			SetSkip((page - 1) * limit)
+		songs, err := utils.FindAndDecode[Song](ctx, db.SongsCollection, filter, opts)
+		if songs == nil && err == nil {
+			songs = []Song{}
+		}
+		return songs, err
+	}
+
+	filter["$or"] = bson.A{
+		bson.M{"genre": bson.M{"$in": topKeys(profile.genres, topGenres)}},
+		bson.M{"artistid": bson.M{"$in": topKeys(profile.artists, topArtists)}},
+		bson.M{"language": bson.M{"$in": topKeys(profile.languages, topLanguages)}},
+	}
+	candidates, err := utils.FindAndDecode[Song](ctx, db.SongsCollection, filter,
+		options.Find().SetSort(bson.D{{Key: "plays", Value: -1}}).SetLimit(maxCandidates))
+	if err != nil {
+		return nil, err
+	}
+
+	maxPlays := 0
+	for _, s := range candidates {
+		maxPlays = max(maxPlays, s.Plays)
+	}
+	scores := make(map[string]float64, len(candidates))
+	for _, s := range candidates {
+		score := genreScore*profile.genres[s.Genre] +
+			artistScore*profile.artists[s.ArtistID] +
+			languageScore*profile.languages[s.Language]
+		if maxPlays > 0 {
+			score += popularityScore * math.Log1p(float64(s.Plays)) / math.Log1p(float64(maxPlays))
+		}
+		scores[s.SongID] = score
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].SongID] > scores[candidates[j].SongID]
+	})
+
+	start, end := pageBounds(int64(len(candidates)), limit, page)
+	return candidates[start:end], nil
+}
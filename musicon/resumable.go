@@ -0,0 +1,745 @@
+package musicon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"naevis/db"
+	"naevis/media"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Upload session statuses
+const (
+	UploadOpen       = "open"
+	UploadFinalizing = "finalizing"
+	UploadComplete   = "complete"
+)
+
+const (
+	defaultMaxResumableUploadMB = 4096
+	defaultUploadChunkSize      = 8 << 20
+	minUploadChunkSize          = 256 << 10
+	maxUploadChunkSize          = 32 << 20
+	// defaultUploadSessionTTL is how long a session may sit idle before it
+	// counts as abandoned. Every chunk received extends it.
+	defaultUploadSessionTTL = 24 * time.Hour
+	uploadSweepInterval     = time.Hour
+	uploadSweepBatch        = 200
+	// chunkReadTimeout replaces the server's short read timeout while a
+	// chunk is received.
+	chunkReadTimeout = 5 * time.Minute
+	// finalizeTimeout is the lease a finalizing session holds. The finalizer
+	// renews it while it works, so only a session whose finalizer died is
+	// swept like an abandoned one.
+	finalizeTimeout = 10 * time.Minute
+	// chunkChecksumHeader carries the hex SHA-256 of a chunk's bytes.
+	chunkChecksumHeader = "X-Chunk-Sha256"
+)
+
+var (
+	errChunkLength    = errors.New("chunk has the wrong length")
+	errUploadChecksum = errors.New("checksum mismatch")
+)
+
+// maxResumableUpload reads MAX_RESUMABLE_UPLOAD_MB, falling back to the
+// default on empty or invalid values.
+func maxResumableUpload() int64 {
+	if v := os.Getenv("MAX_RESUMABLE_UPLOAD_MB"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n << 20
+		}
+		log.Printf("Invalid MAX_RESUMABLE_UPLOAD_MB %q, using %d", v, defaultMaxResumableUploadMB)
+	}
+	return defaultMaxResumableUploadMB << 20
+}
+
+// uploadSessionTTL reads UPLOAD_SESSION_TTL as a Go duration such as "24h",
+// falling back to the default on empty or invalid values.
+func uploadSessionTTL() time.Duration {
+	if v := os.Getenv("UPLOAD_SESSION_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid UPLOAD_SESSION_TTL %q, using %s", v, defaultUploadSessionTTL)
+	}
+	return defaultUploadSessionTTL
+}
+
+// uploadSessionDir holds files still being assembled. It lies outside the
+// public uploads so unfinished files are never served.
+func uploadSessionDir() string {
+	if v := os.Getenv("UPLOAD_SESSION_DIR"); v != "" {
+		return v
+	}
+	return filepath.Join(mediaRoot(), "incoming")
+}
+
+func isSHA256Hex(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// path is where the session's file is assembled.
+func (s UploadSession) path() string {
+	return filepath.Join(uploadSessionDir(), s.UploadID+".part")
+}
+
+func (s UploadSession) totalChunks() int {
+	return int((s.Size + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// chunkRange returns where chunk i starts and how long it is. Only the last
+// chunk may be shorter than ChunkSize.
+func (s UploadSession) chunkRange(i int) (offset, length int64) {
+	offset = int64(i) * s.ChunkSize
+	return offset, min(s.ChunkSize, s.Size-offset)
+}
+
+// missing lists the chunks not received yet, in order.
+func (s UploadSession) missing() []int {
+	have := make(map[int]bool, len(s.Chunks))
+	for _, c := range s.Chunks {
+		have[c] = true
+	}
+	missing := []int{}
+	for i := 0; i < s.totalChunks(); i++ {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// uploadProgress is what a client needs to resume. Offset is the length of
+// the prefix received without gaps, for clients sending chunks in order;
+// Missing lists every chunk still to send, for those sending in parallel.
+func uploadProgress(s UploadSession) map[string]interface{} {
+	missing := s.missing()
+	offset := s.Size
+	if len(missing) > 0 {
+		offset, _ = s.chunkRange(missing[0])
+	}
+	return map[string]interface{}{
+		"uploadid":    s.UploadID,
+		"artistid":    s.ArtistID,
+		"status":      s.Status,
+		"size":        s.Size,
+		"chunkSize":   s.ChunkSize,
+		"totalChunks": s.totalChunks(),
+		"received":    s.totalChunks() - len(missing),
+		"offset":      offset,
+		"missing":     missing,
+		"songid":      s.SongID,
+		"expiresAt":   s.ExpiresAt,
+	}
+}
+
+func loadUploadSession(ctx context.Context, uploadID, userID string) (UploadSession, error) {
+	var s UploadSession
+	err := db.UploadsCollection.FindOne(ctx, bson.M{"uploadid": uploadID, "userid": userID}).Decode(&s)
+	return s, err
+}
+
+func respondUploadLookupError(w http.ResponseWriter, err error) {
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Upload not found")
+	} else {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch upload")
+	}
+}
+
+// discardUpload deletes a session matching filter together with its
+// partial file. The file is only removed once the session is gone, so a
+// session that changed in the meantime keeps it.
+func discardUpload(ctx context.Context, s UploadSession, filter bson.M) (bool, error) {
+	filter["uploadid"] = s.UploadID
+	res, err := db.UploadsCollection.DeleteOne(ctx, filter)
+	if err != nil || res.DeletedCount == 0 {
+		return false, err
+	}
+	if err := os.Remove(s.path()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Uploads: failed to remove %s: %v", s.path(), err)
+	}
+	return true, nil
+}
+
+// writeUploadChunk streams a chunk into the session file at offset, hashing
+// it on the way, and checks its length and checksum.
+func writeUploadChunk(name string, offset, length int64, body io.Reader, checksum string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.NewOffsetWriter(f, offset), io.TeeReader(body, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil:
+		return err
+	case n != length:
+		return errChunkLength
+	case hex.EncodeToString(h.Sum(nil)) != checksum:
+		return errUploadChecksum
+	}
+	return nil
+}
+
+// fileSHA256 hashes a whole file.
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// --------------------------- Handlers ---------------------------
+
+// CreateUploadSession starts a resumable upload of a song for an artist.
+// The body gives the file's name, size and hex SHA-256, optionally a chunk
+// size, and the same song details UploadSong accepts. Chunks are then PUT
+// with PutUploadChunk and the song is created by CompleteUpload.
+func CreateUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	artistID := ps.ByName("artistid")
+	if !requireArtistOwner(w, r, artistID) {
+		return
+	}
+
+	var req struct {
+		FileName    string `json:"fileName"`
+		Size        int64  `json:"size"`
+		SHA256      string `json:"sha256"`
+		ChunkSize   int64  `json:"chunkSize"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Genre       string `json:"genre"`
+		Language    string `json:"language"`
+		Published   bool   `json:"published"`
+	}
+	if err := utils.ParseJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultUploadChunkSize
+	}
+	switch {
+	case req.Size <= 0:
+		respondError(w, http.StatusBadRequest, "size must be positive")
+		return
+	case req.Size > maxResumableUpload():
+		respondError(w, http.StatusRequestEntityTooLarge, "Audio file is too large")
+		return
+	case !isSHA256Hex(req.SHA256):
+		respondError(w, http.StatusBadRequest, "sha256 must be the hex SHA-256 of the whole file")
+		return
+	case req.ChunkSize < minUploadChunkSize || req.ChunkSize > maxUploadChunkSize:
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("chunkSize must be between %d and %d bytes", minUploadChunkSize, maxUploadChunkSize))
+		return
+	}
+
+	fields := map[string]string{
+		"title":       req.Title,
+		"description": req.Description,
+		"genre":       req.Genre,
+		"language":    req.Language,
+	}
+	for name, v := range fields {
+		if len(v) > maxUploadField {
+			respondError(w, http.StatusBadRequest, "Field "+name+" is too long")
+			return
+		}
+	}
+	if req.Published {
+		fields["published"] = "true"
+	}
+
+	now := time.Now()
+	session := UploadSession{
+		UploadID:  "up_" + utils.GenerateRandomString(16),
+		UserID:    utils.GetUserIDFromRequest(r),
+		ArtistID:  artistID,
+		FileName:  filepath.Base(filepath.Clean("/" + req.FileName)),
+		Size:      req.Size,
+		SHA256:    req.SHA256,
+		ChunkSize: req.ChunkSize,
+		Chunks:    []int{},
+		Fields:    fields,
+		Status:    UploadOpen,
+		CreatedAt: now,
+		ExpiresAt: now.Add(uploadSessionTTL()),
+	}
+	if session.FileName == "/" {
+		session.FileName = ""
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := db.UploadsCollection.InsertOne(ctx, session); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start upload")
+		return
+	}
+	respondJSON(w, http.StatusCreated, uploadProgress(session), "Upload started")
+}
+
+// GetUploadSession reports how far an upload got, so a client can resume
+// after losing its connection.
+func GetUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	session, err := loadUploadSession(ctx, ps.ByName("uploadid"), utils.GetUserIDFromRequest(r))
+	if err != nil {
+		respondUploadLookupError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, uploadProgress(session), "Upload fetched successfully")
+}
+
+// PutUploadChunk stores one numbered chunk of an upload. The body is the
+// chunk's raw bytes and the X-Chunk-Sha256 header their hex SHA-256; a
+// chunk failing either check is not counted and can simply be sent again.
+// Chunks may arrive in any order, in parallel, and more than once.
+func PutUploadChunk(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	index, err := strconv.Atoi(ps.ByName("index"))
+	if err != nil || index < 0 {
+		respondError(w, http.StatusBadRequest, "Chunk index must be a non-negative integer")
+		return
+	}
+	checksum := strings.ToLower(r.Header.Get(chunkChecksumHeader))
+	if !isSHA256Hex(checksum) {
+		respondError(w, http.StatusBadRequest, chunkChecksumHeader+" must be the hex SHA-256 of the chunk")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	session, err := loadUploadSession(ctx, ps.ByName("uploadid"), utils.GetUserIDFromRequest(r))
+	cancel()
+	if err != nil {
+		respondUploadLookupError(w, err)
+		return
+	}
+	if session.Status != UploadOpen {
+		respondError(w, http.StatusConflict, "Upload is no longer accepting chunks")
+		return
+	}
+	if index >= session.totalChunks() {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Chunk index must be below %d", session.totalChunks()))
+		return
+	}
+	offset, length := session.chunkRange(index)
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Chunk %d must be %d bytes", index, length))
+		return
+	}
+
+	// Not every ResponseWriter supports deadlines; the server defaults
+	// apply then
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Now().Add(chunkReadTimeout))
+	_ = rc.SetWriteDeadline(time.Now().Add(chunkReadTimeout))
+	body := http.MaxBytesReader(w, r.Body, length)
+	writeErr := writeUploadChunk(session.path(), offset, length, body, checksum)
+
+	ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if writeErr != nil {
+		// The chunk's bytes may have overwritten a good copy, so it no
+		// longer counts as received
+		db.UploadsCollection.UpdateOne(ctx, bson.M{"uploadid": session.UploadID}, bson.M{"$pull": bson.M{"chunks": index}})
+
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(writeErr, errUploadChecksum):
+			respondError(w, http.StatusUnprocessableEntity, "Chunk does not match its checksum")
+		case errors.Is(writeErr, errChunkLength), errors.As(writeErr, &tooLarge):
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Chunk %d must be %d bytes", index, length))
+		default:
+			respondError(w, http.StatusInternalServerError, "Failed to store chunk")
+		}
+		return
+	}
+
+	err = db.UploadsCollection.FindOneAndUpdate(ctx,
+		bson.M{"uploadid": session.UploadID, "status": UploadOpen},
+		bson.M{
+			"$addToSet": bson.M{"chunks": index},
+			"$set":      bson.M{"expiresAt": time.Now().Add(uploadSessionTTL())},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusConflict, "Upload is no longer accepting chunks")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to record chunk")
+		return
+	}
+	respondJSON(w, http.StatusOK, uploadProgress(session), "Chunk received")
+}
+
+// CompleteUpload checks that every chunk arrived and that the assembled
+// file matches the checksum given when the upload started, then hands the
+// file to the same ingestion path as UploadSong. Calling it again after it
+// succeeded returns the song it created.
+func CompleteUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	session, err := loadUploadSession(ctx, ps.ByName("uploadid"), userID)
+	cancel()
+	if err != nil {
+		respondUploadLookupError(w, err)
+		return
+	}
+
+	switch session.Status {
+	case UploadComplete:
+		respondCompletedUpload(w, r, session)
+		return
+	case UploadFinalizing:
+		respondError(w, http.StatusConflict, "Upload is already being finalized")
+		return
+	}
+	if len(session.missing()) > 0 {
+		utils.RespondWithJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"data":    uploadProgress(session),
+			"message": "Upload is missing chunks",
+		})
+		return
+	}
+
+	// Claim the session so further chunks and concurrent calls are refused
+	ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
+	res, err := db.UploadsCollection.UpdateOne(ctx,
+		bson.M{"uploadid": session.UploadID, "status": UploadOpen},
+		bson.M{"$set": bson.M{"status": UploadFinalizing, "expiresAt": time.Now().Add(finalizeTimeout)}})
+	cancel()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to finalize upload")
+		return
+	}
+	if res.ModifiedCount == 0 {
+		respondError(w, http.StatusConflict, "Upload is already being finalized")
+		return
+	}
+
+	// Once claimed, the upload is seen through even if the client hangs
+	// up, so the session never stays stuck finalizing
+	baseCtx := context.WithoutCancel(r.Context())
+	stopLease := holdFinalizeLease(baseCtx, session.UploadID, http.NewResponseController(w))
+	defer stopLease()
+
+	sum, err := fileSHA256(session.path())
+	if err != nil {
+		reopenUpload(baseCtx, session)
+		respondError(w, http.StatusInternalServerError, "Failed to read upload")
+		return
+	}
+
+	var song Song
+	if sum != session.SHA256 {
+		err = errUploadChecksum
+	} else {
+		song, err = finalizeUpload(baseCtx, session)
+	}
+	switch {
+	case errors.Is(err, errUploadChecksum), errors.Is(err, media.ErrUnknownAudio):
+		// The bytes themselves are wrong, so retrying cannot help
+		ctx, cancel := context.WithTimeout(baseCtx, 5*time.Second)
+		defer cancel()
+		if _, derr := discardUpload(ctx, session, bson.M{}); derr != nil {
+			log.Printf("Uploads: failed to discard %s: %v", session.UploadID, derr)
+		}
+		if errors.Is(err, errUploadChecksum) {
+			respondError(w, http.StatusUnprocessableEntity, "Uploaded file does not match its checksum; start a new upload")
+		} else {
+			respondUploadError(w, err)
+		}
+		return
+	case err != nil:
+		// finalizeUpload put the file back, so completing can be retried
+		reopenUpload(baseCtx, session)
+		respondError(w, http.StatusInternalServerError, "Failed to save song")
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(baseCtx, 5*time.Second)
+	defer cancel()
+	if _, err := db.UploadsCollection.UpdateOne(ctx, bson.M{"uploadid": session.UploadID}, bson.M{"$set": bson.M{
+		"status":    UploadComplete,
+		"songid":    song.SongID,
+		"expiresAt": time.Now().Add(uploadSessionTTL()),
+	}}); err != nil {
+		log.Printf("Uploads: failed to mark %s complete: %v", session.UploadID, err)
+	}
+
+	songs := []Song{song}
+	signStreamURLs(songs, userID)
+	respondJSON(w, http.StatusCreated, songs[0], "Song uploaded")
+}
+
+// holdFinalizeLease keeps pushing a finalizing session's expiry ahead until
+// stop is called, so the janitor never sweeps a large file from under a
+// finalizer that is still hashing or moving it. The response's write
+// deadline moves along with it.
+func holdFinalizeLease(ctx context.Context, uploadID string, rc *http.ResponseController) (stop func()) {
+	// Not every ResponseWriter supports deadlines; the server default
+	// applies then
+	_ = rc.SetWriteDeadline(time.Now().Add(finalizeTimeout))
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(finalizeTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_ = rc.SetWriteDeadline(time.Now().Add(finalizeTimeout))
+			opCtx, opCancel := context.WithTimeout(ctx, 5*time.Second)
+			_, err := db.UploadsCollection.UpdateOne(opCtx,
+				bson.M{"uploadid": uploadID, "status": UploadFinalizing},
+				bson.M{"$set": bson.M{"expiresAt": time.Now().Add(finalizeTimeout)}})
+			opCancel()
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Uploads: failed to renew finalize lease of %s: %v", uploadID, err)
+			}
+		}
+	}()
+	// Wait for the renewer so it never touches the response afterwards
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// reopenUpload returns a session that failed to finalize to open, so the
+// client can complete it again.
+func reopenUpload(ctx context.Context, session UploadSession) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := db.UploadsCollection.UpdateOne(ctx,
+		bson.M{"uploadid": session.UploadID, "status": UploadFinalizing},
+		bson.M{"$set": bson.M{"status": UploadOpen, "expiresAt": time.Now().Add(uploadSessionTTL())}},
+	); err != nil {
+		log.Printf("Uploads: failed to reopen %s: %v", session.UploadID, err)
+	}
+}
+
+// finalizeUpload turns a verified upload into a song, moving its file into
+// place. On failure the file is back where the session assembled it.
+func finalizeUpload(ctx context.Context, session UploadSession) (Song, error) {
+	songID := "sg_" + utils.GenerateRandomString(12)
+	saved, err := adoptAudio(session.path(), songID)
+	if err != nil {
+		return Song{}, err
+	}
+	meta, err := inspectAudio(saved)
+	if errors.Is(err, media.ErrUnknownAudio) {
+		// The bytes are not audio, so the session is discarded with them
+		os.Remove(saved.path)
+		return Song{}, err
+	}
+	if err != nil {
+		returnAudio(saved, session)
+		return Song{}, err
+	}
+
+	fileName := session.FileName
+	if fileName == "" {
+		fileName = songID
+	}
+	song := newUploadedSong(songID, session.ArtistID, fileName, session.Fields, saved, meta)
+
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := insertUploadedSong(insertCtx, song); err != nil {
+		returnAudio(saved, session)
+		return Song{}, err
+	}
+	return song, nil
+}
+
+// returnAudio moves an adopted file back to session's path, copying it when
+// the two lie on different disks.
+func returnAudio(saved savedAudio, session UploadSession) {
+	if err := os.Rename(saved.path, session.path()); err == nil {
+		return
+	}
+	err := copyFile(saved.path, session.path())
+	if err != nil {
+		log.Printf("Uploads: failed to return %s to %s: %v", saved.path, session.UploadID, err)
+		return
+	}
+	os.Remove(saved.path)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// respondCompletedUpload answers a repeated CompleteUpload with the song the
+// first call created.
+func respondCompletedUpload(w http.ResponseWriter, r *http.Request, session UploadSession) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var song Song
+	if err := db.SongsCollection.FindOne(ctx, bson.M{"songid": session.SongID}).Decode(&song); err != nil {
+		respondError(w, http.StatusNotFound, "Uploaded song no longer exists")
+		return
+	}
+	songs := []Song{song}
+	signStreamURLs(songs, session.UserID)
+	respondJSON(w, http.StatusOK, songs[0], "Upload already completed")
+}
+
+// AbortUpload cancels an upload and deletes what was received.
+func AbortUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	session, err := loadUploadSession(ctx, ps.ByName("uploadid"), utils.GetUserIDFromRequest(r))
+	if err != nil {
+		respondUploadLookupError(w, err)
+		return
+	}
+	deleted, err := discardUpload(ctx, session, bson.M{"status": bson.M{"$ne": UploadFinalizing}})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to cancel upload")
+		return
+	}
+	if !deleted {
+		respondError(w, http.StatusConflict, "Upload is being finalized")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"uploadid": session.UploadID}, "Upload cancelled")
+}
+
+// --------------------------- Cleanup ---------------------------
+
+// StartUploadJanitor removes expired upload sessions and their partial
+// files, checking once an hour until ctx is cancelled.
+func StartUploadJanitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(uploadSweepInterval)
+		defer ticker.Stop()
+		for {
+			sweepUploads(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// sweepUploads deletes expired sessions in batches, then any partial file
+// that outlived its session.
+func sweepUploads(ctx context.Context) {
+	now := time.Now()
+	for {
+		opCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		expired, err := utils.FindAndDecode[UploadSession](opCtx, db.UploadsCollection,
+			bson.M{"expiresAt": bson.M{"$lt": now}},
+			options.Find().SetProjection(bson.M{"uploadid": 1}).SetLimit(uploadSweepBatch))
+		if err != nil || len(expired) == 0 {
+			cancel()
+			if err != nil {
+				log.Printf("Uploads: failed to list expired sessions: %v", err)
+			}
+			break
+		}
+		for _, s := range expired {
+			// A chunk may have extended the session since it was listed
+			if _, err := discardUpload(opCtx, s, bson.M{"expiresAt": bson.M{"$lt": now}}); err != nil {
+				log.Printf("Uploads: failed to discard %s: %v", s.UploadID, err)
+			}
+		}
+		cancel()
+		if len(expired) < uploadSweepBatch {
+			break
+		}
+	}
+	sweepOrphanedUploadFiles(ctx, now.Add(-uploadSessionTTL()))
+}
+
+// sweepOrphanedUploadFiles removes partial files untouched since cutoff
+// whose session no longer exists, such as those left by a failed removal.
+func sweepOrphanedUploadFiles(ctx context.Context, cutoff time.Time) {
+	dir := uploadSessionDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Uploads: failed to list %s: %v", dir, err)
+		}
+		return
+	}
+	for _, e := range entries {
+		uploadID, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		n, err := db.UploadsCollection.CountDocuments(opCtx, bson.M{"uploadid": uploadID})
+		cancel()
+		if err == nil && n == 0 {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
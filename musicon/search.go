@@ -0,0 +1,514 @@
+package musicon
+
+import (
+	"context"
+	"math"
+	"naevis/db"
+	"naevis/fuzzy"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search result types, as reported in models.Result.Type.
+const (
+	SearchSongs     = "song"
+	SearchAlbums    = "album"
+	SearchArtists   = "artist"
+	SearchPlaylists = "playlist"
+)
+
+const (
+	maxSearchQuery      = 100
+	maxSearchTerms      = 8
+	maxSearchCandidates = 200
+	maxSearchLimit      = 50
+
+	// popularitySearchScore scales the log-popularity boost relative to
+	// text relevance.
+	popularitySearchScore = 0.3
+)
+
+// searchGroups maps the ?type= filter to result types.
+var searchGroups = map[string]string{
+	"songs":     SearchSongs,
+	"albums":    SearchAlbums,
+	"artists":   SearchArtists,
+	"playlists": SearchPlaylists,
+}
+
+// searchQuery is a parsed search request.
+type searchQuery struct {
+	text     string
+	terms    []string
+	genre    string
+	language string
+	// fuzzy tolerates typos in the terms; see fuzzy.Score.
+	fuzzy bool
+}
+
+func parseSearchQuery(raw, genre, language string) searchQuery {
+	text := strings.ToLower(strings.Join(strings.Fields(raw), " "))
+	terms := strings.Fields(text)
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return searchQuery{text: text, terms: terms, genre: genre, language: language}
+}
+
+// textFilter matches documents where any field contains any query term,
+// or in fuzzy mode may contain a misspelling of one.
+func (q searchQuery) textFilter(fields ...string) bson.M {
+	clauses := bson.A{}
+	for _, f := range fields {
+		for _, t := range q.terms {
+			if q.fuzzy {
+				clauses = append(clauses, fuzzy.Filter(f, t))
+			} else {
+				clauses = append(clauses, utils.RegexFilter(f, t))
+			}
+		}
+	}
+	return bson.M{"$or": clauses}
+}
+
+// weightedText is a searchable field and how much a match in it counts.
+type weightedText struct {
+	text   string
+	weight float64
+}
+
+// relevance scores how well fields match q. A field equal to the whole
+// query scores highest, then one starting with it, then whole-word and
+// partial matches of individual terms. In fuzzy mode fields score by how
+// closely their words match the terms instead. Zero means no match.
+func (q searchQuery) relevance(fields ...weightedText) float64 {
+	score := 0.0
+	for _, f := range fields {
+		text := strings.ToLower(f.text)
+		if text == "" {
+			continue
+		}
+		if q.fuzzy {
+			score += 10 * f.weight * fuzzy.Score(q.text, text)
+			continue
+		}
+		switch {
+		case text == q.text:
+			score += 10 * f.weight
+		case strings.HasPrefix(text, q.text):
+			score += 5 * f.weight
+		}
+		words := strings.Fields(text)
+		for _, t := range q.terms {
+			if utils.Contains(words, t) {
+				score += 2 * f.weight
+			} else if strings.Contains(text, t) {
+				score += f.weight
+			}
+		}
+	}
+	return score
+}
+
+// scoredResult is a search hit before pagination.
+type scoredResult struct {
+	result models.Result
+	score  float64
+}
+
+func withPopularity(relevance float64, popularity int) float64 {
+	return relevance + popularitySearchScore*math.Log1p(float64(max(popularity, 0)))
+}
+
+// rankResults orders hits by score, breaking ties by ID for stable pages.
+func rankResults(hits []scoredResult) []models.Result {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].result.ID < hits[j].result.ID
+	})
+	out := make([]models.Result, len(hits))
+	for i, h := range hits {
+		out[i] = h.result
+	}
+	return out
+}
+
+// searchMatch is a candidate document that matched the query.
+type searchMatch[T any] struct {
+	doc       T
+	relevance float64
+}
+
+// matchCandidates returns the documents matching filter that score above
+// zero for relevance. Exact searches consider the maxSearchCandidates
+// matches ranked highest by the popularity field, which the database does
+// cheaply. A fuzzy prefilter is far looser, so cutting it by popularity
+// would drop real matches: every document it lets through is scored, only
+// those that match are kept, and the maxSearchCandidates most relevant
+// are returned.
+func matchCandidates[T any](ctx context.Context, col *mongo.Collection, filter bson.M, popularity string, q searchQuery, relevance func(T) float64) ([]searchMatch[T], error) {
+	opts := options.Find()
+	if !q.fuzzy {
+		opts.SetSort(bson.D{{Key: popularity, Value: -1}}).SetLimit(maxSearchCandidates)
+	}
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var matches []searchMatch[T]
+	for cursor.Next(ctx) {
+		var doc T
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if score := relevance(doc); score > 0 {
+			matches = append(matches, searchMatch[T]{doc, score})
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(matches) > maxSearchCandidates {
+		sort.SliceStable(matches, func(i, j int) bool { return matches[i].relevance > matches[j].relevance })
+		matches = matches[:maxSearchCandidates]
+	}
+	return matches, nil
+}
+
+// songFacetFilter narrows songs by the genre and language filters.
+func (q searchQuery) songFacetFilter() bson.M {
+	filter := bson.M{}
+	if q.genre != "" {
+		filter["genre"] = equalFold(q.genre)
+	}
+	if q.language != "" {
+		filter["language"] = equalFold(q.language)
+	}
+	return filter
+}
+
+func (q searchQuery) hasFacets() bool {
+	return q.genre != "" || q.language != ""
+}
+
+// facetSongs returns which of ids are published songs passing the genre
+// and language filters. Albums and playlists have no genre or language of
+// their own, so they pass when they hold at least one such song.
+func (q searchQuery) facetSongs(ctx context.Context, ids []string) (map[string]bool, error) {
+	filter := q.songFacetFilter()
+	filter["songid"] = bson.M{"$in": ids}
+	filter["published"] = true
+	matched, err := db.SongsCollection.Distinct(ctx, "songid", filter)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(matched))
+	for _, m := range matched {
+		if id, ok := m.(string); ok {
+			set[id] = true
+		}
+	}
+	return set, nil
+}
+
+func searchSongs(ctx context.Context, q searchQuery) ([]scoredResult, error) {
+	filter := q.textFilter("title", "description")
+	for k, v := range q.songFacetFilter() {
+		filter[k] = v
+	}
+	filter["published"] = true
+
+	matches, err := matchCandidates(ctx, db.SongsCollection, filter, "plays", q, func(s Song) float64 {
+		return q.relevance(weightedText{s.Title, 3}, weightedText{s.Description, 1})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]scoredResult, 0, len(matches))
+	for _, m := range matches {
+		s := m.doc
+		hits = append(hits, scoredResult{
+			result: models.Result{
+				Type:        SearchSongs,
+				ID:          s.SongID,
+				Title:       s.Title,
+				Description: s.Description,
+				Category:    s.Genre,
+				Date:        s.UploadedAt,
+				CreatedAt:   s.UploadedAt,
+				Image:       s.Poster,
+			},
+			score: withPopularity(m.relevance, s.Plays+s.Likes),
+		})
+	}
+	return hits, nil
+}
+
+func searchAlbums(ctx context.Context, q searchQuery) ([]scoredResult, error) {
+	filter := q.textFilter("title")
+	filter["published"] = true
+	matches, err := matchCandidates(ctx, db.AlbumsCollection, filter, "likes", q, func(a Album) float64 {
+		return q.relevance(weightedText{a.Title, 3})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed map[string]bool
+	if q.hasFacets() {
+		var ids []string
+		for _, m := range matches {
+			ids = append(ids, m.doc.Songs...)
+		}
+		if allowed, err = q.facetSongs(ctx, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	hits := make([]scoredResult, 0, len(matches))
+	for _, m := range matches {
+		a := m.doc
+		if allowed != nil && !anyAllowed(a.Songs, allowed) {
+			continue
+		}
+		released, _ := time.Parse("2006-01-02", a.ReleaseDate)
+		hits = append(hits, scoredResult{
+			result: models.Result{
+				Type:        SearchAlbums,
+				ID:          a.AlbumID,
+				Title:       a.Title,
+				Description: a.Description,
+				Date:        released,
+				Image:       a.CoverURL,
+			},
+			score: withPopularity(m.relevance, a.Likes),
+		})
+	}
+	return hits, nil
+}
+
+func searchArtists(ctx context.Context, q searchQuery) ([]scoredResult, error) {
+	// Artists carry genres but no language
+	if q.language != "" {
+		return nil, nil
+	}
+	filter := q.textFilter("name")
+	if q.genre != "" {
+		filter["genres"] = equalFold(q.genre)
+	}
+	matches, err := matchCandidates(ctx, db.ArtistsCollection, filter, "followers", q, func(a models.Artist) float64 {
+		return q.relevance(weightedText{a.Name, 3})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]scoredResult, 0, len(matches))
+	for _, m := range matches {
+		a := m.doc
+		hits = append(hits, scoredResult{
+			result: models.Result{
+				Type:        SearchArtists,
+				ID:          a.ArtistID,
+				Name:        a.Name,
+				Description: a.Bio,
+				Category:    a.Category,
+				Location:    a.Country,
+				CreatedAt:   a.CreatedAt,
+				Image:       a.Photo,
+			},
+			score: withPopularity(m.relevance, a.Followers),
+		})
+	}
+	return hits, nil
+}
+
+// searchPlaylists only looks at public playlists; unlisted ones are meant
+// to be reachable by link alone.
+func searchPlaylists(ctx context.Context, q searchQuery) ([]scoredResult, error) {
+	filter := q.textFilter("name")
+	filter["visibility"] = VisibilityPublic
+	matches, err := matchCandidates(ctx, db.PlaylistsCollection, live(filter), "followers", q, func(p Playlist) float64 {
+		return q.relevance(weightedText{p.Name, 3}, weightedText{p.Description, 1})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed map[string]bool
+	if q.hasFacets() {
+		var ids []string
+		for _, m := range matches {
+			ids = append(ids, entrySongIDs(m.doc.Songs)...)
+		}
+		if allowed, err = q.facetSongs(ctx, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	hits := make([]scoredResult, 0, len(matches))
+	for _, m := range matches {
+		p := m.doc
+		if allowed != nil && !anyAllowed(entrySongIDs(p.Songs), allowed) {
+			continue
+		}
+		hits = append(hits, scoredResult{
+			result: models.Result{
+				Type:        SearchPlaylists,
+				ID:          p.PlaylistID,
+				Name:        p.Name,
+				Description: p.Description,
+				Userid:      p.UserID,
+				CreatedAt:   p.CreatedAt,
+				Image:       p.CoverURL,
+			},
+			score: withPopularity(m.relevance, p.Followers),
+		})
+	}
+	return hits, nil
+}
+
+func anyAllowed(ids []string, allowed map[string]bool) bool {
+	for _, id := range ids {
+		if allowed[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// runSearch searches the requested result types and returns each group
+// ranked but not yet paginated.
+func runSearch(ctx context.Context, q searchQuery, types []string) (map[string][]models.Result, error) {
+	groups := map[string][]models.Result{}
+	for _, t := range types {
+		var hits []scoredResult
+		var err error
+		switch t {
+		case SearchSongs:
+			hits, err = searchSongs(ctx, q)
+		case SearchAlbums:
+			hits, err = searchAlbums(ctx, q)
+		case SearchArtists:
+			hits, err = searchArtists(ctx, q)
+		case SearchPlaylists:
+			hits, err = searchPlaylists(ctx, q)
+		}
+		if err != nil {
+			return nil, err
+		}
+		groups[t] = rankResults(hits)
+	}
+	return groups, nil
+}
+
+func searchEmpty(groups map[string][]models.Result) bool {
+	for _, results := range groups {
+		if len(results) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// didYouMean proposes a corrected query from the titles and names the
+// fuzzy search matched, or "" when there is nothing to correct.
+func didYouMean(q searchQuery, groups map[string][]models.Result) string {
+	var vocabulary []string
+	for _, results := range groups {
+		for _, r := range results {
+			vocabulary = append(vocabulary, r.Title, r.Name)
+		}
+	}
+	text := fuzzy.Fold(q.text)
+	suggestion := fuzzy.DidYouMean(text, vocabulary)
+	if suggestion == text {
+		return ""
+	}
+	return suggestion
+}
+
+// Search looks up songs, albums, artists and public playlists.
+//
+// Query parameters: search (required), type (songs, albums, artists or
+// playlists; all when omitted), genre, language, page and limit. Results
+// are grouped by type, ranked by text relevance with a boost for
+// popularity, and each group is paginated separately. When nothing matches
+// exactly the search is retried tolerating typos, and the response carries
+// a didYouMean correction built from what that retry found.
+func Search(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	opts := utils.ParseQueryOptions(r)
+	if len(opts.Search) > maxSearchQuery {
+		respondError(w, http.StatusBadRequest, "Search query is too long")
+		return
+	}
+	q := parseSearchQuery(opts.Search, opts.Genre, r.URL.Query().Get("language"))
+	if len(q.terms) == 0 {
+		respondError(w, http.StatusBadRequest, "Missing search query")
+		return
+	}
+
+	types := []string{SearchSongs, SearchAlbums, SearchArtists, SearchPlaylists}
+	if group := r.URL.Query().Get("type"); group != "" {
+		t, ok := searchGroups[group]
+		if !ok {
+			respondError(w, http.StatusBadRequest, "Type must be songs, albums, artists or playlists")
+			return
+		}
+		types = []string{t}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	groups, err := runSearch(ctx, q, types)
+	suggestion := ""
+	if err == nil && searchEmpty(groups) {
+		q.fuzzy = true
+		if groups, err = runSearch(ctx, q, types); err == nil {
+			suggestion = didYouMean(q, groups)
+		}
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Search failed")
+		return
+	}
+
+	limit := min(opts.Limit, maxSearchLimit)
+	page := map[string]interface{}{}
+	total := map[string]int{}
+	for group, t := range searchGroups {
+		results, ok := groups[t]
+		if !ok {
+			continue
+		}
+		total[group] = len(results)
+		lo, hi := pageBounds(int64(len(results)), int64(limit), int64(opts.Page))
+		page[group] = results[lo:hi]
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"query":      opts.Search,
+		"didYouMean": suggestion,
+		"fuzzy":      q.fuzzy,
+		"page":       opts.Page,
+		"limit":      limit,
+		"total":      total,
+		"results":    page,
+	}, "Search results fetched")
+}
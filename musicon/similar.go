@@ -0,0 +1,321 @@
+package musicon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"naevis/db"
+	"naevis/rdx"
+	"naevis/utils"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxCooccurPlaylists bounds how many playlists containing the seed are
+	// scanned for co-occurring songs.
+	maxCooccurPlaylists = 500
+	maxCooccurSongs     = 200
+	maxSimilarByTags    = 500
+
+	// radioSessionTTL is how long an idle radio session is kept.
+	radioSessionTTL = 6 * time.Hour
+	maxRadioBatch   = 50
+)
+
+// Weights used when scoring a song's similarity to a seed.
+const (
+	cooccurScore      = 3.0
+	sameArtistScore   = 2.0
+	sameGenreScore    = 1.5
+	sameLanguageScore = 0.5
+	similarPopScore   = 0.25
+)
+
+// cooccurringSongs counts, for each song sharing a public playlist with
+// seedID, how many playlists they share. Private and unlisted playlists are
+// left out so their contents cannot be inferred. Legacy playlists that
+// store plain song-ID strings are included.
+func cooccurringSongs(ctx context.Context, seedID string) (map[string]int, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: live(bson.M{
+			"visibility": VisibilityPublic,
+			"$or":        bson.A{bson.M{"songs.songid": seedID}, bson.M{"songs": seedID}},
+		})}},
+		{{Key: "$limit", Value: maxCooccurPlaylists}},
+		{{Key: "$project", Value: bson.M{"songs": 1}}},
+		{{Key: "$unwind", Value: "$songs"}},
+		{{Key: "$project", Value: bson.M{"songid": bson.M{"$ifNull": bson.A{"$songs.songid", "$songs"}}}}},
+		{{Key: "$match", Value: bson.M{"songid": bson.M{"$ne": seedID}}}},
+		// Count each playlist once per song, however often it repeats there
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"playlist": "$_id", "songid": "$songid"}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$_id.songid", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: maxCooccurSongs}},
+	}
+
+	cursor, err := db.PlaylistsCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		SongID string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.SongID] = row.Count
+	}
+	return counts, nil
+}
+
+// similarSongs ranks published songs by similarity to seed: shared
+// playlists weigh most, then the same artist, genre and language, with a
+// small boost for popularity. Songs in exclude are skipped.
+func similarSongs(ctx context.Context, seed Song, exclude []string, n int) ([]Song, error) {
+	cooccur, err := cooccurringSongs(ctx, seed.SongID)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := append([]string{seed.SongID}, exclude...)
+	tags := bson.A{}
+	if seed.ArtistID != "" {
+		tags = append(tags, bson.M{"artistid": seed.ArtistID})
+	}
+	if seed.Genre != "" {
+		tags = append(tags, bson.M{"genre": seed.Genre})
+	}
+	if seed.Language != "" {
+		tags = append(tags, bson.M{"language": seed.Language})
+	}
+	if len(cooccur) > 0 {
+		ids := make([]string, 0, len(cooccur))
+		for id := range cooccur {
+			ids = append(ids, id)
+		}
+		tags = append(tags, bson.M{"songid": bson.M{"$in": ids}})
+	}
+	if len(tags) == 0 {
+		return []Song{}, nil
+	}
+
+	candidates, err := utils.FindAndDecode[Song](ctx, db.SongsCollection,
+		bson.M{"published": true, "songid": bson.M{"$nin": skip}, "$or": tags},
+		options.Find().SetSort(bson.D{{Key: "plays", Value: -1}}).SetLimit(maxSimilarByTags+maxCooccurSongs))
+	if err != nil {
+		return nil, err
+	}
+
+	maxCooccur, maxPlays := 0, 0
+	for _, c := range cooccur {
+		maxCooccur = max(maxCooccur, c)
+	}
+	for _, s := range candidates {
+		maxPlays = max(maxPlays, s.Plays)
+	}
+
+	scores := make(map[string]float64, len(candidates))
+	for _, s := range candidates {
+		score := 0.0
+		if maxCooccur > 0 {
+			score += cooccurScore * float64(cooccur[s.SongID]) / float64(maxCooccur)
+		}
+		if seed.ArtistID != "" && s.ArtistID == seed.ArtistID {
+			score += sameArtistScore
+		}
+		if seed.Genre != "" && s.Genre == seed.Genre {
+			score += sameGenreScore
+		}
+		if seed.Language != "" && s.Language == seed.Language {
+			score += sameLanguageScore
+		}
+		if maxPlays > 0 {
+			score += similarPopScore * math.Log1p(float64(s.Plays)) / math.Log1p(float64(maxPlays))
+		}
+		scores[s.SongID] = score
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].SongID] > scores[candidates[j].SongID]
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates, nil
+}
+
+func findPublishedSong(ctx context.Context, songID string) (Song, error) {
+	var song Song
+	err := db.SongsCollection.FindOne(ctx, bson.M{"songid": songID, "published": true}).Decode(&song)
+	return song, err
+}
+
+// GetSimilarSongs lists songs similar to the given one.
+func GetSimilarSongs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	songID := ps.ByName("songid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	seed, err := findPublishedSong(ctx, songID)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found or unpublished")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch song")
+		return
+	}
+
+	limit, _ := getPaginationParams(r)
+	songs, err := similarSongs(ctx, seed, nil, int(limit))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch similar songs")
+		return
+	}
+	signStreamURLs(songs, utils.GetUserIDFromRequest(r))
+
+	respondJSON(w, http.StatusOK, songs, fmt.Sprintf("Songs similar to %s fetched", songID))
+}
+
+// --------------------------- Radio ---------------------------
+
+// A radio session is a hash of its station's song, the user it was started
+// for and the current seed, plus a set of the songs already played.
+func radioKey(session string) string     { return "radio:" + session }
+func radioSeenKey(session string) string { return "radio:" + session + ":seen" }
+
+// radioBatch picks up to limit songs similar to seedID, falling back to the
+// station's own song once the drifted seed runs dry and topping up with
+// popular songs so the station never runs out early.
+func radioBatch(ctx context.Context, songID, seedID string, exclude []string, limit int64) ([]Song, error) {
+	seed, err := findPublishedSong(ctx, seedID)
+	if err == mongo.ErrNoDocuments && seedID != songID {
+		seedID = songID
+		seed, err = findPublishedSong(ctx, songID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	songs, err := similarSongs(ctx, seed, exclude, int(limit))
+	if err == nil && len(songs) == 0 && seedID != songID {
+		if seed, err = findPublishedSong(ctx, songID); err == nil {
+			songs, err = similarSongs(ctx, seed, exclude, int(limit))
+		}
+	}
+	if err != nil || int64(len(songs)) >= limit {
+		return songs, err
+	}
+	taken := append(append([]string{}, exclude...), songIDsOf(songs)...)
+	more, err := utils.FindAndDecode[Song](ctx, db.SongsCollection,
+		bson.M{"published": true, "songid": bson.M{"$nin": taken}},
+		options.Find().SetSort(bson.D{{Key: "plays", Value: -1}}).SetLimit(limit-int64(len(songs))))
+	return append(songs, more...), err
+}
+
+// GetSongRadio returns the next batch of an endless radio station seeded by
+// a song. The first call starts a session; passing its ID back as
+// ?session= continues it without repeating tracks. A session only
+// continues the station of the song and user it was started for. Each
+// batch is seeded by the last track of the previous one, so the station
+// drifts away from the original song over time. Once nothing unplayed is
+// left the session starts over with a fresh batch.
+func GetSongRadio(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	songID := ps.ByName("songid")
+	userID := utils.GetUserIDFromRequest(r)
+	session := r.URL.Query().Get("session")
+
+	limit, _ := getPaginationParams(r)
+	limit = min(limit, maxRadioBatch)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	seedID := songID
+	var seen []string
+	if session == "" {
+		session = "rd_" + utils.GenerateRandomString(16)
+	} else {
+		state, err := rdx.Conn.HGetAll(ctx, radioKey(session)).Result()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to load radio session")
+			return
+		}
+		// Someone else's session, or one for another station, looks the
+		// same as an expired one
+		if len(state) == 0 || state["song"] != songID || state["user"] != userID {
+			respondError(w, http.StatusNotFound, "Radio session expired")
+			return
+		}
+		seedID = state["seed"]
+		if seen, err = rdx.Conn.SMembers(ctx, radioSeenKey(session)).Result(); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to load radio session")
+			return
+		}
+	}
+
+	songs, err := radioBatch(ctx, songID, seedID, append([]string{songID}, seen...), limit)
+	reset := err == nil && len(songs) == 0 && len(seen) > 0
+	if reset {
+		// Everything has been played: start the rotation over
+		songs, err = radioBatch(ctx, songID, songID, []string{songID}, limit)
+	}
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found or unpublished")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch radio")
+		return
+	}
+
+	seedID = songID
+	if len(songs) > 0 {
+		seedID = songs[len(songs)-1].SongID
+	}
+	pipe := rdx.Conn.TxPipeline()
+	if reset {
+		pipe.Del(ctx, radioSeenKey(session))
+	}
+	pipe.HSet(ctx, radioKey(session), "song", songID, "user", userID, "seed", seedID)
+	pipe.Expire(ctx, radioKey(session), radioSessionTTL)
+	if len(songs) > 0 {
+		members := make([]interface{}, len(songs))
+		for i, s := range songs {
+			members[i] = s.SongID
+		}
+		pipe.SAdd(ctx, radioSeenKey(session), members...)
+		pipe.Expire(ctx, radioSeenKey(session), radioSessionTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save radio session")
+		return
+	}
+
+	signStreamURLs(songs, userID)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"session": session,
+		"songs":   songs,
+	}, fmt.Sprintf("Radio for %s fetched", songID))
+}
+
+func songIDsOf(songs []Song) []string {
+	ids := make([]string, len(songs))
+	for i, s := range songs {
+		ids[i] = s.SongID
+	}
+	return ids
+}
@@ -0,0 +1,343 @@
+package musicon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Smart playlist rule fields.
+const (
+	RuleGenre      = "genre"
+	RuleLanguage   = "language"
+	RuleArtist     = "artistid"
+	RulePlays      = "plays"
+	RuleUploadedAt = "uploadedAt"
+)
+
+// Smart playlist rule operators. In and NotIn take Values; Gte and Lte take
+// Number; WithinDays takes Number as a count of days back from now; After and
+// Before take a single YYYY-MM-DD date in Values.
+const (
+	RuleIn         = "in"
+	RuleNotIn      = "not_in"
+	RuleGte        = "gte"
+	RuleLte        = "lte"
+	RuleWithinDays = "within_days"
+	RuleAfter      = "after"
+	RuleBefore     = "before"
+)
+
+// How the rules of a group are combined.
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// Smart playlist sort orders.
+const (
+	SmartSortNewest      = "newest"
+	SmartSortOldest      = "oldest"
+	SmartSortMostPlayed  = "most_played"
+	SmartSortLeastPlayed = "least_played"
+	SmartSortTitle       = "title"
+)
+
+const (
+	defaultSmartLimit = 100
+	maxSmartLimit     = 500
+	maxSmartRules     = 20
+	maxSmartDepth     = 3
+	maxRuleValues     = 50
+	ruleDateLayout    = "2006-01-02"
+)
+
+var errSmartPlaylist = errors.New("smart playlists are defined by rules")
+
+// SmartRule is a single condition on a song field.
+type SmartRule struct {
+	Field  string   `json:"field" bson:"field"`
+	Op     string   `json:"op" bson:"op"`
+	Values []string `json:"values,omitempty" bson:"values,omitempty"`
+	Number int64    `json:"number,omitempty" bson:"number,omitempty"`
+}
+
+// SmartRules defines a rule-based playlist. Rules and nested Groups are
+// combined with AND when Match is "all" and with OR when it is "any". Sort
+// and Limit only apply at the top level.
+type SmartRules struct {
+	Match  string       `json:"match" bson:"match"`
+	Rules  []SmartRule  `json:"rules,omitempty" bson:"rules,omitempty"`
+	Groups []SmartRules `json:"groups,omitempty" bson:"groups,omitempty"`
+	Sort   string       `json:"sort,omitempty" bson:"sort,omitempty"`
+	Limit  int          `json:"limit,omitempty" bson:"limit,omitempty"`
+}
+
+// validate checks the rule tree and fills in defaults for Match, Sort and
+// Limit.
+func (s *SmartRules) validate() error {
+	if err := s.validateGroup(1); err != nil {
+		return err
+	}
+	switch s.Sort {
+	case "":
+		s.Sort = SmartSortNewest
+	case SmartSortNewest, SmartSortOldest, SmartSortMostPlayed, SmartSortLeastPlayed, SmartSortTitle:
+	default:
+		return fmt.Errorf("unknown sort %q", s.Sort)
+	}
+	if s.Limit == 0 {
+		s.Limit = defaultSmartLimit
+	}
+	if s.Limit < 0 || s.Limit > maxSmartLimit {
+		return fmt.Errorf("limit must be 1-%d", maxSmartLimit)
+	}
+	return nil
+}
+
+func (s *SmartRules) validateGroup(depth int) error {
+	if depth > maxSmartDepth {
+		return fmt.Errorf("rule groups may be nested at most %d deep", maxSmartDepth)
+	}
+	if s.Match == "" {
+		s.Match = MatchAll
+	} else if s.Match != MatchAll && s.Match != MatchAny {
+		return errors.New("match must be all or any")
+	}
+	if n := len(s.Rules) + len(s.Groups); n == 0 || n > maxSmartRules {
+		return fmt.Errorf("each group needs 1-%d rules", maxSmartRules)
+	}
+	for _, rule := range s.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	for i := range s.Groups {
+		if s.Groups[i].Sort != "" || s.Groups[i].Limit != 0 {
+			return errors.New("sort and limit are only allowed at the top level")
+		}
+		if err := s.Groups[i].validateGroup(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r SmartRule) validate() error {
+	switch r.Field {
+	case RuleGenre, RuleLanguage, RuleArtist:
+		if r.Op != RuleIn && r.Op != RuleNotIn {
+			return fmt.Errorf("%s supports in and not_in", r.Field)
+		}
+		if len(r.Values) == 0 || len(r.Values) > maxRuleValues {
+			return fmt.Errorf("%s needs 1-%d values", r.Field, maxRuleValues)
+		}
+	case RulePlays:
+		if r.Op != RuleGte && r.Op != RuleLte {
+			return errors.New("plays supports gte and lte")
+		}
+		if r.Number < 0 {
+			return errors.New("plays threshold must not be negative")
+		}
+	case RuleUploadedAt:
+		switch r.Op {
+		case RuleWithinDays:
+			if r.Number <= 0 {
+				return errors.New("within_days needs a positive number of days")
+			}
+		case RuleAfter, RuleBefore:
+			if len(r.Values) != 1 {
+				return fmt.Errorf("%s needs exactly one date", r.Op)
+			}
+			if _, err := time.Parse(ruleDateLayout, r.Values[0]); err != nil {
+				return fmt.Errorf("dates must be in %s form", ruleDateLayout)
+			}
+		default:
+			return errors.New("uploadedAt supports within_days, after and before")
+		}
+	default:
+		return fmt.Errorf("unknown rule field %q", r.Field)
+	}
+	return nil
+}
+
+// condition translates a validated rule into a song query. Relative dates
+// are resolved against now, so a "last 30 days" playlist keeps rolling.
+// Unplayed songs have no plays field and count as 0 plays.
+func (r SmartRule) condition(now time.Time) bson.M {
+	switch r.Field {
+	case RulePlays:
+		cond := bson.M{"plays": bson.M{"$" + r.Op: r.Number}}
+		if r.Op == RuleLte || r.Number <= 0 {
+			return bson.M{"$or": bson.A{cond, bson.M{"plays": nil}}}
+		}
+		return cond
+	case RuleUploadedAt:
+		switch r.Op {
+		case RuleWithinDays:
+			return bson.M{"uploadedAt": bson.M{"$gte": now.AddDate(0, 0, -int(r.Number))}}
+		case RuleAfter:
+			t, _ := time.Parse(ruleDateLayout, r.Values[0])
+			return bson.M{"uploadedAt": bson.M{"$gte": t}}
+		default:
+			t, _ := time.Parse(ruleDateLayout, r.Values[0])
+			return bson.M{"uploadedAt": bson.M{"$lt": t}}
+		}
+	default:
+		op := "$in"
+		if r.Op == RuleNotIn {
+			op = "$nin"
+		}
+		return bson.M{r.Field: bson.M{op: r.Values}}
+	}
+}
+
+func (s *SmartRules) condition(now time.Time) bson.M {
+	clauses := make(bson.A, 0, len(s.Rules)+len(s.Groups))
+	for _, rule := range s.Rules {
+		clauses = append(clauses, rule.condition(now))
+	}
+	for i := range s.Groups {
+		clauses = append(clauses, s.Groups[i].condition(now))
+	}
+	if s.Match == MatchAny {
+		return bson.M{"$or": clauses}
+	}
+	return bson.M{"$and": clauses}
+}
+
+func (s *SmartRules) sortOrder() bson.D {
+	switch s.Sort {
+	case SmartSortOldest:
+		return bson.D{{Key: "uploadedAt", Value: 1}, {Key: "songid", Value: 1}}
+	case SmartSortMostPlayed:
+		return bson.D{{Key: "plays", Value: -1}, {Key: "songid", Value: 1}}
+	case SmartSortLeastPlayed:
+		return bson.D{{Key: "plays", Value: 1}, {Key: "songid", Value: 1}}
+	case SmartSortTitle:
+		return bson.D{{Key: "title", Value: 1}, {Key: "songid", Value: 1}}
+	default:
+		return bson.D{{Key: "uploadedAt", Value: -1}, {Key: "songid", Value: 1}}
+	}
+}
+
+// evaluateSmartRules returns the published songs currently matching rules.
+func evaluateSmartRules(ctx context.Context, rules *SmartRules) ([]Song, error) {
+	filter := bson.M{"$and": bson.A{
+		bson.M{"published": true},
+		rules.condition(time.Now()),
+	}}
+	opts := options.Find().SetSort(rules.sortOrder()).SetLimit(int64(rules.Limit))
+
+	songs, err := utils.FindAndDecode[Song](ctx, db.SongsCollection, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if songs == nil {
+		songs = []Song{}
+	}
+	return songs, nil
+}
+
+// playlistSongIDs returns the songs a playlist currently holds in order,
+// evaluating the rules of smart playlists.
+func playlistSongIDs(ctx context.Context, p *Playlist) ([]string, error) {
+	if p.Rules == nil {
+		return entrySongIDs(p.Songs), nil
+	}
+	songs, err := evaluateSmartRules(ctx, p.Rules)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(songs))
+	for i, s := range songs {
+		ids[i] = s.SongID
+	}
+	return ids, nil
+}
+
+// smartPlaylistTracks evaluates a smart playlist for GetPlaylistSongs. The
+// tracks have no entry IDs since they are not stored on the playlist.
+func smartPlaylistTracks(ctx context.Context, rules *SmartRules, viewerID string) ([]PlaylistTrack, error) {
+	songs, err := evaluateSmartRules(ctx, rules)
+	if err != nil {
+		return nil, err
+	}
+	signStreamURLs(songs, viewerID)
+	tracks := make([]PlaylistTrack, len(songs))
+	for i, s := range songs {
+		tracks[i] = PlaylistTrack{Song: s}
+	}
+	return tracks, nil
+}
+
+// isSongEdit reports whether op edits a playlist's fixed song list, which
+// smart playlists do not have.
+func isSongEdit(op string) bool {
+	return op == OpAddSongs || op == OpRemoveSongs || op == OpMoveEntry
+}
+
+// --------------------------- Smart Playlist Handlers ---------------------------
+
+// SetPlaylistRules turns a playlist into a smart playlist, or replaces the
+// rules of one. Any fixed song list is kept and comes back if the rules are
+// cleared again.
+func SetPlaylistRules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	var rules SmartRules
+	if err := utils.ParseJSON(r, &rules); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON input")
+		return
+	}
+	if err := rules.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rules: "+err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	p, err := updatePlaylist(ctx, editablePlaylistFilter(playlistID, userID), userID, OpUpdateRules, func(p *Playlist) error {
+		p.Rules = &rules
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, p, "Playlist rules updated")
+}
+
+// ClearPlaylistRules turns a smart playlist back into a regular one.
+func ClearPlaylistRules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	p, err := updatePlaylist(ctx, editablePlaylistFilter(playlistID, userID), userID, OpUpdateRules, func(p *Playlist) error {
+		if p.Rules == nil {
+			return errNoChange
+		}
+		p.Rules = nil
+		return nil
+	})
+	if err != nil {
+		respondPlaylistWriteError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, p, "Playlist rules cleared")
+}
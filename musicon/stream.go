@@ -0,0 +1,279 @@
+package musicon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"naevis/db"
+	"naevis/globals"
+	"naevis/media"
+	"naevis/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultStreamURLTTL = time.Hour
+	streamPath          = "/api/v1/musicon/songs/%s/stream"
+	// streamWriteTimeout replaces the server's short write timeout for the
+	// duration of a stream, so long songs on slow links are not cut off.
+	streamWriteTimeout = 30 * time.Minute
+)
+
+// audioMimeTypes covers audio and HLS extensions the standard library may
+// not know.
+var audioMimeTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".webm": "audio/webm",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// mediaRoot is the directory audio paths are resolved against. Public
+// paths like /uploads/... map to files under it, as for uploaded images.
+func mediaRoot() string {
+	if v := os.Getenv("MEDIA_ROOT"); v != "" {
+		return v
+	}
+	return "static"
+}
+
+// audioFilePath resolves where a song's audio lives on disk. AudioURL may
+// be a public path or a full URL on the public host; only its path is used,
+// and it cannot escape mediaRoot. Songs without one are looked up by ID.
+func audioFilePath(s Song) string {
+	p := s.AudioURL
+	if u, err := url.Parse(p); err == nil && u.Scheme != "" {
+		p = u.Path
+	}
+	if p == "" {
+		p = path.Join("uploads", "audio", s.SongID+s.AudioExtn)
+	}
+	return filepath.Join(mediaRoot(), filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func audioContentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := audioMimeTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// --------------------------- Signed URLs ---------------------------
+
+// streamURLTTL reads STREAM_URL_TTL as a Go duration such as "1h",
+// falling back to the default on empty or invalid values.
+func streamURLTTL() time.Duration {
+	if v := os.Getenv("STREAM_URL_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid STREAM_URL_TTL %q, using %s", v, defaultStreamURLTTL)
+	}
+	return defaultStreamURLTTL
+}
+
+// streamGrant is what a signed stream URL carries: which song may be
+// fetched, by whom and until when.
+type streamGrant struct {
+	songID  string
+	userID  string
+	expires int64
+	sig     string
+}
+
+// streamSignature MACs everything a stream URL is bound to.
+func streamSignature(songID, userID string, expires int64) string {
+	mac := hmac.New(sha256.New, globals.StreamSigningKey())
+	fmt.Fprintf(mac, "%s\n%s\n%d", songID, userID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newStreamGrant signs access to songID that expires after streamURLTTL.
+// A non-empty userID binds it to that user. Expiry is rounded up to the
+// minute so repeated fetches yield the same, cacheable URL without ever
+// cutting the TTL short.
+func newStreamGrant(songID, userID string) streamGrant {
+	at := time.Now().Add(streamURLTTL())
+	if t := at.Truncate(time.Minute); t.Before(at) {
+		at = t.Add(time.Minute)
+	}
+	expires := at.Unix()
+	return streamGrant{
+		songID:  songID,
+		userID:  userID,
+		expires: expires,
+		sig:     streamSignature(songID, userID, expires),
+	}
+}
+
+// query encodes the grant as URL query parameters.
+func (g streamGrant) query() string {
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(g.expires, 10))
+	if g.userID != "" {
+		q.Set("uid", g.userID)
+	}
+	q.Set("sig", g.sig)
+	return q.Encode()
+}
+
+// token encodes the grant as a single path segment. HLS players resolve
+// segment URIs relative to the playlist URL and drop its query string, so
+// HLS URLs carry the grant in the path instead.
+func (g streamGrant) token() string {
+	return fmt.Sprintf("%d.%s.%s", g.expires, g.sig, g.userID)
+}
+
+func grantFromQuery(songID string, q url.Values) (streamGrant, bool) {
+	expires, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return streamGrant{}, false
+	}
+	return streamGrant{songID: songID, userID: q.Get("uid"), expires: expires, sig: q.Get("sig")}, true
+}
+
+func grantFromToken(songID, token string) (streamGrant, bool) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return streamGrant{}, false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return streamGrant{}, false
+	}
+	return streamGrant{songID: songID, userID: parts[2], expires: expires, sig: parts[1]}, true
+}
+
+// verify checks the grant's signature and expiry for a request and returns
+// how long it stays valid. The signature covers the bound user, so it
+// cannot be reassigned; players such as <audio> elements send no
+// Authorization header, so the signature alone is trusted and a request is
+// only refused when it does identify a different user.
+func (g streamGrant) verify(r *http.Request) (time.Duration, bool) {
+	remaining := time.Until(time.Unix(g.expires, 0))
+	if remaining <= 0 {
+		return 0, false
+	}
+	if caller := utils.GetUserIDFromRequest(r); g.userID != "" && caller != "" && caller != g.userID {
+		return 0, false
+	}
+	want := streamSignature(g.songID, g.userID, g.expires)
+	if !hmac.Equal([]byte(g.sig), []byte(want)) {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// signStreamURLs replaces each song's raw AudioURL with a signed stream URL
+// for userID, and points songs packaged for HLS at a signed master playlist.
+func signStreamURLs(songs []Song, userID string) {
+	for i := range songs {
+		grant := newStreamGrant(songs[i].SongID, userID)
+		songs[i].AudioURL = fmt.Sprintf(streamPath, url.PathEscape(songs[i].SongID)) + "?" + grant.query()
+		if hls := songs[i].HLS; hls != nil && hls.Status == HLSReady {
+			hls.MasterURL = hlsURL(grant, media.HLSMasterPlaylist)
+		}
+	}
+}
+
+// --------------------------- Streaming ---------------------------
+
+// StreamSong serves a published song's audio through a signed URL, as
+// issued by signStreamURLs. It supports Range requests with 206 Partial
+// Content so players can seek, and conditional requests through ETag and
+// Last-Modified.
+//
+// The global no-store caching and same-origin resource policy set by
+// middleware.SecurityHeaders are relaxed here; otherwise every seek would
+// refetch from the start and players on another origin could not load the
+// file at all. Responses are cached privately until the URL expires.
+func StreamSong(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	songID := ps.ByName("songid")
+
+	grant, ok := grantFromQuery(songID, r.URL.Query())
+	var valid time.Duration
+	if ok {
+		valid, ok = grant.verify(r)
+	}
+	if !ok {
+		respondError(w, http.StatusForbidden, "Stream link is missing, invalid or expired")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var song Song
+	err := db.SongsCollection.FindOne(ctx, bson.M{"songid": songID, "published": true},
+		options.FindOne().SetProjection(bson.M{"songid": 1, "audioUrl": 1, "audioextn": 1})).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		respondError(w, http.StatusNotFound, "Song not found or unpublished")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch song")
+		return
+	}
+
+	serveAudioFile(w, r, audioFilePath(song), valid)
+}
+
+// serveAudioFile writes the file at name with range and caching support,
+// letting clients cache it for cacheFor.
+func serveAudioFile(w http.ResponseWriter, r *http.Request, name string, cacheFor time.Duration) {
+	f, err := os.Open(name)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Audio not available")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		respondError(w, http.StatusNotFound, "Audio not available")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", audioContentType(name))
+	h.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(cacheFor.Seconds())))
+	h.Del("Pragma")
+	h.Del("Expires")
+	h.Set("Cross-Origin-Resource-Policy", "cross-origin")
+
+	// Not every ResponseWriter supports deadlines; the server default
+	// applies then
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+	// ServeContent handles Range, If-Range, If-None-Match and
+	// If-Modified-Since, answering 206, 304 or 416 as appropriate
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,402 @@
+package musicon
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"naevis/db"
+	"naevis/fuzzy"
+	"naevis/models"
+	"naevis/rdx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// suggestChannel is the Redis channel mq.Emit publishes index events on.
+	suggestChannel = "indexing-events"
+
+	suggestPrefixKey = "suggest:prefix:"
+	suggestItemKey   = "suggest:item:"
+	// suggestBuiltKey marks a recent full rebuild. It expires so that
+	// popularity scores, which plays do not update, are refreshed daily.
+	suggestBuiltKey = "suggest:built"
+
+	maxSuggestPrefix   = 20
+	maxSuggestWords    = 6
+	maxPrefixMembers   = 500
+	defaultSuggestions = 10
+	maxSuggestions     = 25
+
+	suggestRebuildEvery = 24 * time.Hour
+	suggestCheckEvery   = time.Hour
+)
+
+// Suggestion is one autocomplete entry.
+type Suggestion struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// suggestPrefixes lists the index prefixes of text: every prefix of the
+// folded text starting at each of its first few words, so "the beatles"
+// is found by both "the b" and "beat".
+func suggestPrefixes(text string) []string {
+	folded := fuzzy.Fold(text)
+	seen := map[string]bool{}
+	var out []string
+
+	start := 0
+	for w := 0; w < maxSuggestWords && start < len(folded); w++ {
+		tail := []rune(folded[start:])
+		for n := 1; n <= len(tail) && n <= maxSuggestPrefix; n++ {
+			p := string(tail[:n])
+			if !seen[p] {
+				seen[p] = true
+				out = append(out, p)
+			}
+		}
+		next := strings.IndexByte(folded[start:], ' ')
+		if next < 0 {
+			break
+		}
+		start += next + 1
+	}
+	return out
+}
+
+func suggestMember(entityType, id string) string { return entityType + "|" + id }
+
+// removeSuggestion drops an item from every prefix it was indexed under.
+func removeSuggestion(ctx context.Context, entityType, id string) error {
+	member := suggestMember(entityType, id)
+	old, err := rdx.Conn.HGet(ctx, suggestItemKey+member, "prefixes").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	pipe := rdx.Conn.TxPipeline()
+	for _, p := range strings.Split(old, "\n") {
+		if p != "" {
+			pipe.ZRem(ctx, suggestPrefixKey+p, member)
+		}
+	}
+	pipe.Del(ctx, suggestItemKey+member)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// indexSuggestion (re)indexes an item under the prefixes of text, scored by
+// popularity. Each prefix keeps only its most popular members; less popular
+// items stay reachable through longer prefixes.
+func indexSuggestion(ctx context.Context, entityType, id, text string, popularity int) error {
+	if err := removeSuggestion(ctx, entityType, id); err != nil {
+		return err
+	}
+	prefixes := suggestPrefixes(text)
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	member := suggestMember(entityType, id)
+	pipe := rdx.Conn.TxPipeline()
+	for _, p := range prefixes {
+		key := suggestPrefixKey + p
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(popularity), Member: member})
+		pipe.ZRemRangeByRank(ctx, key, 0, -maxPrefixMembers-1)
+	}
+	pipe.HSet(ctx, suggestItemKey+member,
+		"type", entityType,
+		"id", id,
+		"text", text,
+		"prefixes", strings.Join(prefixes, "\n"),
+		"indexedAt", time.Now().UnixNano(),
+	)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// refreshSuggestion reloads one song, album or artist and indexes or
+// removes it.
+func refreshSuggestion(ctx context.Context, entityType, id string) error {
+	var text string
+	var popularity int
+	var err error
+	switch entityType {
+	case SearchSongs:
+		var s Song
+		err = db.SongsCollection.FindOne(ctx, bson.M{"songid": id, "published": true}).Decode(&s)
+		text, popularity = s.Title, s.Plays+s.Likes
+	case SearchAlbums:
+		var a Album
+		err = db.AlbumsCollection.FindOne(ctx, bson.M{"albumid": id, "published": true}).Decode(&a)
+		text, popularity = a.Title, a.Likes
+	case SearchArtists:
+		var a models.Artist
+		err = db.ArtistsCollection.FindOne(ctx, bson.M{"artistid": id}).Decode(&a)
+		text, popularity = a.Name, a.Followers
+	default:
+		return nil
+	}
+	if err == mongo.ErrNoDocuments {
+		return removeSuggestion(ctx, entityType, id)
+	}
+	if err != nil {
+		return err
+	}
+	return indexSuggestion(ctx, entityType, id, text, popularity)
+}
+
+// handleIndexEvent applies one event from the indexing-events channel.
+// Events for other entity types are ignored.
+func handleIndexEvent(ctx context.Context, payload string) {
+	var ev models.Index
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		log.Printf("Suggest: bad index event %q: %v", payload, err)
+		return
+	}
+	if ev.EntityId == "" {
+		return
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var err error
+	if strings.EqualFold(ev.Method, "DELETE") {
+		err = removeSuggestion(opCtx, ev.EntityType, ev.EntityId)
+	} else {
+		err = refreshSuggestion(opCtx, ev.EntityType, ev.EntityId)
+	}
+	if err != nil {
+		log.Printf("Suggest: failed to apply %s %s %s: %v", ev.Method, ev.EntityType, ev.EntityId, err)
+	}
+}
+
+// rebuildSuggestions indexes every published song and album and every
+// artist from scratch, then removes indexed items that are no longer among
+// them, such as those whose delete event was missed.
+func rebuildSuggestions(ctx context.Context) error {
+	type source struct {
+		entityType string
+		collection *mongo.Collection
+		filter     bson.M
+	}
+	sources := []source{
+		{SearchSongs, db.SongsCollection, bson.M{"published": true}},
+		{SearchAlbums, db.AlbumsCollection, bson.M{"published": true}},
+		{SearchArtists, db.ArtistsCollection, bson.M{}},
+	}
+
+	started := time.Now()
+	indexed := map[string]bool{}
+	for _, src := range sources {
+		cursor, err := src.collection.Find(ctx, src.filter,
+			options.Find().SetProjection(bson.M{
+				"songid": 1, "albumid": 1, "artistid": 1,
+				"title": 1, "name": 1,
+				"plays": 1, "likes": 1, "followers": 1,
+			}))
+		if err != nil {
+			return err
+		}
+		for cursor.Next(ctx) {
+			var doc struct {
+				SongID    string `bson:"songid"`
+				AlbumID   string `bson:"albumid"`
+				ArtistID  string `bson:"artistid"`
+				Title     string `bson:"title"`
+				Name      string `bson:"name"`
+				Plays     int    `bson:"plays"`
+				Likes     int    `bson:"likes"`
+				Followers int    `bson:"followers"`
+			}
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			var id, text string
+			switch src.entityType {
+			case SearchSongs:
+				id, text = doc.SongID, doc.Title
+			case SearchAlbums:
+				id, text = doc.AlbumID, doc.Title
+			default:
+				id, text = doc.ArtistID, doc.Name
+			}
+			if err := indexSuggestion(ctx, src.entityType, id, text, doc.Plays+doc.Likes+doc.Followers); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			indexed[suggestMember(src.entityType, id)] = true
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	removed, err := removeStaleSuggestions(ctx, indexed, started)
+	if err != nil {
+		return err
+	}
+	log.Printf("Suggest: indexed %d items, removed %d stale", len(indexed), removed)
+	return nil
+}
+
+// removeStaleSuggestions drops every indexed item whose member is not in
+// keep and returns how many it dropped. Items indexed since since were
+// added by index events while the rebuild ran, and are kept too.
+func removeStaleSuggestions(ctx context.Context, keep map[string]bool, since time.Time) (int, error) {
+	removed := 0
+	iter := rdx.Conn.Scan(ctx, 0, suggestItemKey+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		member := strings.TrimPrefix(iter.Val(), suggestItemKey)
+		if keep[member] {
+			continue
+		}
+		at, err := rdx.Conn.HGet(ctx, iter.Val(), "indexedAt").Int64()
+		if err != nil && err != redis.Nil {
+			return removed, err
+		}
+		if at >= since.UnixNano() {
+			continue
+		}
+		entityType, id, ok := strings.Cut(member, "|")
+		if !ok {
+			continue
+		}
+		if err := removeSuggestion(ctx, entityType, id); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, iter.Err()
+}
+
+// StartSuggestIndexer keeps the autocomplete index current. It applies
+// index events as mq.Emit publishes them and rebuilds the whole index when
+// the last rebuild is more than a day old, until ctx is cancelled.
+func StartSuggestIndexer(ctx context.Context) {
+	sub := rdx.Conn.Subscribe(ctx, suggestChannel)
+	go func() {
+		defer sub.Close()
+		events := sub.Channel()
+		ticker := time.NewTicker(suggestCheckEvery)
+		defer ticker.Stop()
+
+		rebuildIfStale := func() {
+			fresh, err := rdx.Conn.SetNX(ctx, suggestBuiltKey, time.Now().Format(time.RFC3339), suggestRebuildEvery).Result()
+			if err != nil || !fresh {
+				return
+			}
+			if err := rebuildSuggestions(ctx); err != nil {
+				log.Printf("Suggest: rebuild failed: %v", err)
+				rdx.Conn.Del(ctx, suggestBuiltKey)
+			}
+		}
+		rebuildIfStale()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-events:
+				if !ok {
+					return
+				}
+				handleIndexEvent(ctx, msg.Payload)
+			case <-ticker.C:
+				rebuildIfStale()
+			}
+		}
+	}()
+}
+
+// Suggest returns autocomplete entries for ?q=, most popular first.
+// ?type= (songs, albums or artists) narrows them and ?limit= caps them.
+func Suggest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	prefix := fuzzy.Fold(q.Get("q"))
+	if prefix == "" {
+		respondJSON(w, http.StatusOK, []Suggestion{}, "Suggestions fetched")
+		return
+	}
+
+	only := ""
+	if group := q.Get("type"); group != "" {
+		t, ok := searchGroups[group]
+		if !ok || t == SearchPlaylists {
+			respondError(w, http.StatusBadRequest, "Type must be songs, albums or artists")
+			return
+		}
+		only = t
+	}
+
+	limit := defaultSuggestions
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = min(n, maxSuggestions)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	// Prefixes are only indexed up to maxSuggestPrefix runes; longer input
+	// is matched against the stored text
+	key := prefix
+	if runes := []rune(prefix); len(runes) > maxSuggestPrefix {
+		key = string(runes[:maxSuggestPrefix])
+	}
+	fetch := int64(limit)
+	if only != "" || key != prefix {
+		fetch = maxPrefixMembers
+	}
+	members, err := rdx.Conn.ZRevRange(ctx, suggestPrefixKey+key, 0, fetch-1).Result()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch suggestions")
+		return
+	}
+
+	pipe := rdx.Conn.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(members))
+	for i, m := range members {
+		cmds[i] = pipe.HMGet(ctx, suggestItemKey+m, "type", "id", "text")
+	}
+	if len(members) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			respondError(w, http.StatusInternalServerError, "Failed to fetch suggestions")
+			return
+		}
+	}
+
+	suggestions := make([]Suggestion, 0, limit)
+	for _, cmd := range cmds {
+		vals := cmd.Val()
+		if len(vals) != 3 || vals[0] == nil || vals[1] == nil || vals[2] == nil {
+			continue
+		}
+		s := Suggestion{Type: vals[0].(string), ID: vals[1].(string), Text: vals[2].(string)}
+		if only != "" && s.Type != only {
+			continue
+		}
+		if key != prefix && !strings.Contains(" "+fuzzy.Fold(s.Text), " "+prefix) {
+			continue
+		}
+		suggestions = append(suggestions, s)
+		if len(suggestions) == limit {
+			break
+		}
+	}
+
+	respondJSON(w, http.StatusOK, suggestions, "Suggestions fetched")
+}
@@ -0,0 +1,165 @@
+package musicon
+
+import (
+	"context"
+	"log"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultTrashRetention applies when PLAYLIST_TRASH_RETENTION is unset.
+	defaultTrashRetention = 30 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+	trashPurgeBatch       = 500
+)
+
+// OpRestore marks a playlist coming back out of the trash.
+const OpRestore = "restore"
+
+// live restricts a playlist query to playlists that are not in the trash.
+// A nil match covers both a missing and a null deletedAt.
+func live(filter bson.M) bson.M {
+	filter["deletedAt"] = nil
+	return filter
+}
+
+// trashRetention reads PLAYLIST_TRASH_RETENTION as a Go duration such as
+// "720h", falling back to the default on empty or invalid values.
+func trashRetention() time.Duration {
+	if v := os.Getenv("PLAYLIST_TRASH_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid PLAYLIST_TRASH_RETENTION %q, using %s", v, defaultTrashRetention)
+	}
+	return defaultTrashRetention
+}
+
+// GetPlaylistTrash lists the caller's deleted playlists, most recent first.
+func GetPlaylistTrash(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deletedAt", Value: -1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	filter := bson.M{"userid": userID, "deletedAt": bson.M{"$ne": nil}}
+	playlists, err := utils.FindAndDecode[Playlist](ctx, db.PlaylistsCollection, filter, opts)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch trash")
+		return
+	}
+	if playlists == nil {
+		playlists = []Playlist{}
+	}
+
+	respondJSON(w, http.StatusOK, playlists, "Trash fetched successfully")
+}
+
+// RestorePlaylist brings a deleted playlist back out of the trash.
+func RestorePlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID := utils.GetUserIDFromRequest(r)
+	playlistID := ps.ByName("playlistid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var restored Playlist
+	err := db.PlaylistsCollection.FindOneAndUpdate(ctx,
+		bson.M{"playlistid": playlistID, "userid": userID, "deletedAt": bson.M{"$ne": nil}},
+		bson.M{
+			"$unset": bson.M{"deletedAt": ""},
+			"$inc":   bson.M{"revision": 1},
+			"$set":   bson.M{"updatedAt": time.Now()},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&restored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			respondError(w, http.StatusNotFound, "Playlist not found in trash")
+		} else {
+			respondError(w, http.StatusInternalServerError, "Failed to restore playlist")
+		}
+		return
+	}
+
+	recordPlaylistChange(ctx, playlistID, restored.Revision, userID, OpRestore, nil, snapshotOf(&restored))
+
+	respondJSON(w, http.StatusOK, restored, "Playlist restored successfully")
+}
+
+// StartPlaylistPurger permanently removes playlists that have sat in the
+// trash longer than the retention period, checking once an hour until ctx
+// is cancelled.
+func StartPlaylistPurger(ctx context.Context) {
+	retention := trashRetention()
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			purgeTrashedPlaylists(ctx, retention)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeTrashedPlaylists deletes expired playlists together with their
+// follows and change history, in batches.
+func purgeTrashedPlaylists(ctx context.Context, retention time.Duration) {
+	cutoff := time.Now().Add(-retention)
+	for {
+		opCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		expired, err := utils.FindAndDecode[Playlist](opCtx, db.PlaylistsCollection,
+			bson.M{"deletedAt": bson.M{"$lt": cutoff}},
+			options.Find().SetProjection(bson.M{"playlistid": 1}).SetLimit(trashPurgeBatch))
+		if err != nil || len(expired) == 0 {
+			cancel()
+			if err != nil {
+				log.Printf("Playlist purge: failed to list expired playlists: %v", err)
+			}
+			return
+		}
+
+		ids := make([]string, len(expired))
+		for i, p := range expired {
+			ids[i] = p.PlaylistID
+		}
+		match := bson.M{"playlistid": bson.M{"$in": ids}}
+
+		res, err := db.PlaylistsCollection.DeleteMany(opCtx, bson.M{"playlistid": bson.M{"$in": ids}, "deletedAt": bson.M{"$lt": cutoff}})
+		if err == nil {
+			_, err = db.PlaylistFollowsCollection.DeleteMany(opCtx, match)
+		}
+		if err == nil {
+			_, err = db.PlaylistHistoryCollection.DeleteMany(opCtx, match)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Playlist purge: %v", err)
+			return
+		}
+
+		log.Printf("Playlist purge: removed %d playlists deleted before %s", res.DeletedCount, cutoff.Format(time.RFC3339))
+		if len(expired) < trashPurgeBatch {
+			return
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package musicon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"naevis/db"
+	"naevis/media"
+	"naevis/models"
+	"naevis/mq"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultMaxAudioUploadMB = 200
+	// uploadReadTimeout replaces the server's short read timeout while an
+	// upload is received.
+	uploadReadTimeout = 30 * time.Minute
+	maxUploadField    = 4 << 10
+	// audioUploadDir is where uploaded audio is stored, relative to
+	// mediaRoot and as a public path.
+	audioUploadDir = "uploads/audio"
+)
+
+// songUploadFields are the form fields accepted alongside uploaded audio.
+var songUploadFields = map[string]bool{
+	"title": true, "description": true, "genre": true, "language": true, "published": true,
+}
+
+// maxAudioUpload reads MAX_AUDIO_UPLOAD_MB, falling back to the default on
+// empty or invalid values.
+func maxAudioUpload() int64 {
+	if v := os.Getenv("MAX_AUDIO_UPLOAD_MB"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n << 20
+		}
+		log.Printf("Invalid MAX_AUDIO_UPLOAD_MB %q, using %d", v, defaultMaxAudioUploadMB)
+	}
+	return defaultMaxAudioUploadMB << 20
+}
+
+// savedAudio is an uploaded audio file stored under mediaRoot.
+type savedAudio struct {
+	path   string
+	format string
+	size   int64
+}
+
+// audioUploadPath is where songID's audio in format is stored, creating
+// the directory if needed.
+func audioUploadPath(songID, format string) (string, error) {
+	dir := filepath.Join(mediaRoot(), filepath.FromSlash(audioUploadDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, songID+"."+format), nil
+}
+
+// storeAudio streams src to songID's audio file without buffering it in
+// memory. The format is sniffed from the first bytes; unrecognised files
+// fail with media.ErrUnknownAudio and nothing is kept on any failure.
+func storeAudio(src io.Reader, songID string) (savedAudio, error) {
+	br := bufio.NewReaderSize(src, 64<<10)
+	head, _ := br.Peek(media.AudioSniffLen)
+	format := media.SniffAudioFormat(head)
+	if format == "" {
+		return savedAudio{}, media.ErrUnknownAudio
+	}
+
+	final, err := audioUploadPath(songID, format)
+	if err != nil {
+		return savedAudio{}, err
+	}
+	tmp := final + ".part"
+
+	out, err := os.Create(tmp)
+	if err != nil {
+		return savedAudio{}, err
+	}
+	size, err := io.Copy(out, br)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return savedAudio{}, err
+	}
+	return savedAudio{path: final, format: format, size: size}, nil
+}
+
+// adoptAudio moves a file assembled elsewhere into place as songID's audio,
+// sniffing its format like storeAudio. Files on another disk are copied.
+func adoptAudio(name, songID string) (savedAudio, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return savedAudio{}, err
+	}
+	head := make([]byte, media.AudioSniffLen)
+	n, _ := io.ReadFull(f, head)
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return savedAudio{}, err
+	}
+	format := media.SniffAudioFormat(head[:n])
+	if format == "" {
+		return savedAudio{}, media.ErrUnknownAudio
+	}
+
+	final, err := audioUploadPath(songID, format)
+	if err != nil {
+		return savedAudio{}, err
+	}
+	if err := os.Rename(name, final); err != nil {
+		src, err := os.Open(name)
+		if err != nil {
+			return savedAudio{}, err
+		}
+		saved, err := storeAudio(src, songID)
+		src.Close()
+		if err == nil {
+			os.Remove(name)
+		}
+		return saved, err
+	}
+	return savedAudio{path: final, format: format, size: info.Size()}, nil
+}
+
+// inspectAudio reads the duration and tags of a stored file.
+func inspectAudio(saved savedAudio) (media.AudioMeta, error) {
+	f, err := os.Open(saved.path)
+	if err != nil {
+		return media.AudioMeta{}, err
+	}
+	defer f.Close()
+	return media.ReadAudioMeta(f, saved.size, saved.format)
+}
+
+// newUploadedSong builds the song record for a stored upload. Tags pre-fill
+// the title, genre, language and duration; form fields override them, and
+// the file name is the title of last resort. Songs stay unpublished unless
+// the form says otherwise.
+func newUploadedSong(songID, artistID, fileName string, fields map[string]string, saved savedAudio, meta media.AudioMeta) Song {
+	pick := func(field, tag string) string {
+		if v := strings.TrimSpace(fields[field]); v != "" {
+			return v
+		}
+		return tag
+	}
+
+	song := Song{
+		SongID:      songID,
+		ArtistID:    artistID,
+		Title:       pick("title", meta.Title),
+		Genre:       pick("genre", meta.Genre),
+		Language:    pick("language", meta.Language),
+		Description: strings.TrimSpace(fields["description"]),
+		AudioURL:    "/" + path.Join(audioUploadDir, songID+"."+saved.format),
+		AudioExtn:   "." + saved.format,
+		Published:   fields["published"] == "true",
+		UploadedAt:  time.Now(),
+	}
+	if song.Title == "" {
+		song.Title = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	}
+	if meta.Duration > 0 {
+		song.Duration = formatSongDuration(int(meta.Duration.Round(time.Second) / time.Second))
+	}
+	return song
+}
+
+// insertUploadedSong stores a new song, announces it to the indexers and
+// queues it for HLS packaging.
+func insertUploadedSong(ctx context.Context, song Song) error {
+	if _, err := db.SongsCollection.InsertOne(ctx, song); err != nil {
+		return err
+	}
+	mq.Emit(ctx, "song-uploaded", models.Index{
+		EntityType: SearchSongs,
+		Method:     "POST",
+		EntityId:   song.SongID,
+		ItemId:     song.ArtistID,
+		ItemType:   SearchArtists,
+	})
+	if err := queueHLS(ctx, song.SongID); err != nil {
+		log.Printf("HLS: failed to queue uploaded song %s: %v", song.SongID, err)
+	}
+	return nil
+}
+
+// respondUploadError maps a failure while receiving audio to a status.
+func respondUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		respondError(w, http.StatusRequestEntityTooLarge, "Audio file is too large")
+	case errors.Is(err, media.ErrUnknownAudio):
+		respondError(w, http.StatusUnsupportedMediaType, "Audio must be MP3, FLAC, OGG, WAV or M4A")
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to store audio")
+	}
+}
+
+// requireArtistOwner checks that the caller manages artistID, answering
+// the request itself when they do not.
+func requireArtistOwner(w http.ResponseWriter, r *http.Request, artistID string) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	owner, err := ownsArtist(ctx, utils.GetUserIDFromRequest(r), artistID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return false
+	}
+	if !owner {
+		respondError(w, http.StatusForbidden, "You do not manage this artist")
+		return false
+	}
+	return true
+}
+
+// UploadSong adds a song to an artist from a multipart upload: an "audio"
+// file part plus optional title, description, genre, language and
+// published fields, in any order. The file is streamed straight to disk.
+// Its real format is sniffed from its content, and its duration and tags
+// pre-fill the song.
+func UploadSong(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	artistID := ps.ByName("artistid")
+	if !requireArtistOwner(w, r, artistID) {
+		return
+	}
+
+	// Not every ResponseWriter supports deadlines; the server defaults
+	// apply then. The write deadline covers the response sent after a
+	// long upload.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Now().Add(uploadReadTimeout))
+	_ = rc.SetWriteDeadline(time.Now().Add(uploadReadTimeout))
+	r.Body = http.MaxBytesReader(w, r.Body, maxAudioUpload())
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Expected a multipart/form-data upload")
+		return
+	}
+
+	songID := "sg_" + utils.GenerateRandomString(12)
+	fields := map[string]string{}
+	var saved *savedAudio
+	var fileName string
+	created := false
+	defer func() {
+		if saved != nil && !created {
+			os.Remove(saved.path)
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respondUploadError(w, err)
+			} else {
+				respondError(w, http.StatusBadRequest, "Malformed multipart body")
+			}
+			return
+		}
+
+		name := part.FormName()
+		switch {
+		case name == "audio":
+			if saved != nil {
+				respondError(w, http.StatusBadRequest, "Upload one audio file at a time")
+				return
+			}
+			s, err := storeAudio(part, songID)
+			if err != nil {
+				respondUploadError(w, err)
+				return
+			}
+			saved, fileName = &s, part.FileName()
+			if fileName == "" {
+				fileName = songID
+			}
+		case songUploadFields[name]:
+			v, err := io.ReadAll(io.LimitReader(part, maxUploadField+1))
+			if err != nil || len(v) > maxUploadField {
+				respondError(w, http.StatusBadRequest, "Field "+name+" is too long")
+				return
+			}
+			fields[name] = string(v)
+		}
+		part.Close()
+	}
+	if saved == nil {
+		respondError(w, http.StatusBadRequest, "Missing audio file")
+		return
+	}
+
+	meta, err := inspectAudio(*saved)
+	if errors.Is(err, media.ErrUnknownAudio) {
+		respondUploadError(w, err)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read audio")
+		return
+	}
+	song := newUploadedSong(songID, artistID, fileName, fields, *saved, meta)
+	if song.Title == "" {
+		respondError(w, http.StatusBadRequest, "Song title is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := insertUploadedSong(ctx, song); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save song")
+		return
+	}
+	created = true
+
+	songs := []Song{song}
+	signStreamURLs(songs, utils.GetUserIDFromRequest(r))
+	respondJSON(w, http.StatusCreated, songs[0], "Song uploaded")
+}
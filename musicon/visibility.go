@@ -0,0 +1,86 @@
+package musicon
+
+import (
+	"context"
+	"fmt"
+	"naevis/db"
+	"naevis/utils"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Playlist visibility levels. Private playlists are readable only by their
+// owner, unlisted ones by anyone holding the ID, and public ones are also
+// listed on the owner's profile. Documents without a visibility field are
+// treated as private.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+func validVisibility(v string) bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+// canViewPlaylist reports whether userID may read p. userID may be empty for
+// anonymous callers.
+func canViewPlaylist(p *Playlist, userID string) bool {
+	if (userID != "" && p.UserID == userID) || isCollaborator(p, userID) {
+		return true
+	}
+	return p.Visibility == VisibilityPublic || p.Visibility == VisibilityUnlisted
+}
+
+// hideCollaborators clears the collaborators, pending invites included, of
+// playlists viewerID does not own.
+func hideCollaborators(playlists []Playlist, viewerID string) {
+	for i := range playlists {
+		if playlists[i].UserID != viewerID {
+			playlists[i].Collaborators = nil
+		}
+	}
+}
+
+// GetPublicUserPlaylists lists another user's public playlists for their
+// profile page. Collaborators, including pending invites, are only shown to
+// the owner.
+func GetPublicUserPlaylists(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ownerID := ps.ByName("userid")
+	callerID := utils.GetUserIDFromRequest(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	limit, page := getPaginationParams(r)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+	if callerID == "" || callerID != ownerID {
+		opts.SetProjection(bson.M{"collaborators": 0})
+	}
+
+	cursor, err := db.PlaylistsCollection.Find(ctx, live(bson.M{"userid": ownerID, "visibility": VisibilityPublic}), opts)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch playlists")
+		return
+	}
+	defer cursor.Close(ctx)
+
+	playlists := []Playlist{}
+	if err := cursor.All(ctx, &playlists); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to decode playlists")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, playlists, fmt.Sprintf("Public playlists for user %s fetched", ownerID))
+}
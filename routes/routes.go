@@ -11,16 +11,59 @@ import (
 func AddMusicRoutes(router *httprouter.Router, rateLimiter *ratelim.RateLimiter) {
 	// --------------------------- PLAYLISTS ---------------------------
 	router.GET("/api/v1/musicon/user/playlists", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetUserPlaylists)))
-	router.GET("/api/v1/musicon/user/liked", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetUserLikes)))
+	router.GET("/api/v1/musicon/users/:userid/playlists", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetPublicUserPlaylists)))
 	router.POST("/api/v1/musicon/playlists", rateLimiter.Limit(middleware.Authenticate(musicon.CreatePlaylist)))
 	router.DELETE("/api/v1/musicon/playlists/:playlistid", rateLimiter.Limit(middleware.Authenticate(musicon.DeletePlaylist)))
 
 	// Add / Remove songs to playlist
 	// router.POST("/api/v1/musicon/playlists/:playlistid/songs/:songid", rateLimiter.Limit(middleware.Authenticate(musicon.AddSongToPlaylist)))
 	router.POST("/api/v1/musicon/playlists/:playlistid/songs", rateLimiter.Limit(middleware.Authenticate(musicon.AddSongToPlaylist)))
-	router.POST("/api/v1/musicon/user/liked/:songid", rateLimiter.Limit(middleware.OptionalAuth(musicon.SetUserLikes)))
+	router.DELETE("/api/v1/musicon/playlists/:playlistid/songs", rateLimiter.Limit(middleware.Authenticate(musicon.RemoveSongsFromPlaylist)))
 	router.DELETE("/api/v1/musicon/playlists/:playlistid/songs/:songid", rateLimiter.Limit(middleware.Authenticate(musicon.RemoveSongFromPlaylist)))
 
+	// Liked songs
+	router.GET("/api/v1/musicon/user/liked", rateLimiter.Limit(middleware.Authenticate(musicon.GetUserLikes)))
+	router.POST("/api/v1/musicon/user/liked/:songid", rateLimiter.Limit(middleware.Authenticate(musicon.LikeSong)))
+	router.DELETE("/api/v1/musicon/user/liked/:songid", rateLimiter.Limit(middleware.Authenticate(musicon.UnlikeSong)))
+	router.POST("/api/v1/musicon/user/likes/check", rateLimiter.Limit(middleware.Authenticate(musicon.CheckLikedSongs)))
+
+	// Library: saved songs, albums, artists and playlists
+	router.GET("/api/v1/musicon/user/library", rateLimiter.Limit(middleware.Authenticate(musicon.GetLibraryCounts)))
+	router.GET("/api/v1/musicon/user/library/:type", rateLimiter.Limit(middleware.Authenticate(musicon.GetLibraryItems)))
+	router.POST("/api/v1/musicon/user/library/:type/:id", rateLimiter.Limit(middleware.Authenticate(musicon.SaveToLibrary)))
+	router.DELETE("/api/v1/musicon/user/library/:type/:id", rateLimiter.Limit(middleware.Authenticate(musicon.RemoveFromLibrary)))
+
+	// Ordered entries: move or remove a single occurrence
+	router.PATCH("/api/v1/musicon/playlists/:playlistid/entries/:entryid", rateLimiter.Limit(middleware.Authenticate(musicon.MovePlaylistEntry)))
+	router.DELETE("/api/v1/musicon/playlists/:playlistid/entries/:entryid", rateLimiter.Limit(middleware.Authenticate(musicon.RemovePlaylistEntry)))
+
+	// Smart playlists: set or clear the rules that define the songs
+	router.PUT("/api/v1/musicon/playlists/:playlistid/rules", rateLimiter.Limit(middleware.Authenticate(musicon.SetPlaylistRules)))
+	router.DELETE("/api/v1/musicon/playlists/:playlistid/rules", rateLimiter.Limit(middleware.Authenticate(musicon.ClearPlaylistRules)))
+
+	// Trash: list and restore soft-deleted playlists
+	router.GET("/api/v1/musicon/user/trash", rateLimiter.Limit(middleware.Authenticate(musicon.GetPlaylistTrash)))
+	router.POST("/api/v1/musicon/playlists/:playlistid/restore", rateLimiter.Limit(middleware.Authenticate(musicon.RestorePlaylist)))
+
+	// Change history and undo
+	router.GET("/api/v1/musicon/playlists/:playlistid/history", rateLimiter.Limit(middleware.Authenticate(musicon.GetPlaylistHistory)))
+	router.POST("/api/v1/musicon/playlists/:playlistid/history/:revision/restore", rateLimiter.Limit(middleware.Authenticate(musicon.RestorePlaylistRevision)))
+
+	// Save a copy of a playlist or album
+	router.POST("/api/v1/musicon/playlists/:playlistid/fork", rateLimiter.Limit(middleware.Authenticate(musicon.ForkPlaylist)))
+	router.POST("/api/v1/musicon/albums/:albumid/fork", rateLimiter.Limit(middleware.Authenticate(musicon.ForkAlbum)))
+	router.POST("/api/v1/musicon/user/likes/fork", rateLimiter.Limit(middleware.Authenticate(musicon.ForkLikedSongs)))
+
+	// Follow / unfollow other users' playlists
+	router.POST("/api/v1/musicon/playlists/:playlistid/follow", rateLimiter.Limit(middleware.Authenticate(musicon.FollowPlaylist)))
+	router.DELETE("/api/v1/musicon/playlists/:playlistid/follow", rateLimiter.Limit(middleware.Authenticate(musicon.UnfollowPlaylist)))
+
+	// Collaborators
+	router.GET("/api/v1/musicon/user/invites", rateLimiter.Limit(middleware.Authenticate(musicon.GetPlaylistInvites)))
+	router.POST("/api/v1/musicon/playlists/:playlistid/collaborators", rateLimiter.Limit(middleware.Authenticate(musicon.InviteCollaborator)))
+	router.POST("/api/v1/musicon/playlists/:playlistid/collaborators/accept", rateLimiter.Limit(middleware.Authenticate(musicon.AcceptCollaboration)))
+	router.DELETE("/api/v1/musicon/playlists/:playlistid/collaborators/:userid", rateLimiter.Limit(middleware.Authenticate(musicon.RevokeCollaborator)))
+
 	// Playlist details
 	router.GET("/api/v1/musicon/playlists/:playlistid/songs", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetPlaylistSongs)))
 
@@ -29,15 +72,50 @@ func AddMusicRoutes(router *httprouter.Router, rateLimiter *ratelim.RateLimiter)
 
 	// --------------------------- ARTISTS ---------------------------
 	router.GET("/api/v1/musicon/artists/:artistid/songs", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetArtistsSongs)))
+	router.POST("/api/v1/musicon/artists/:artistid/songs", rateLimiter.Limit(middleware.Authenticate(middleware.RequireRoles("artist")(musicon.UploadSong))))
+
+	// Resumable uploads: start a session, PUT numbered chunks, check
+	// progress, then complete it into a song
+	router.POST("/api/v1/musicon/artists/:artistid/uploads", rateLimiter.Limit(middleware.Authenticate(middleware.RequireRoles("artist")(musicon.CreateUploadSession))))
+	router.GET("/api/v1/musicon/uploads/:uploadid", rateLimiter.Limit(middleware.Authenticate(middleware.RequireRoles("artist")(musicon.GetUploadSession))))
+	router.PUT("/api/v1/musicon/uploads/:uploadid/chunks/:index", rateLimiter.Limit(middleware.Authenticate(middleware.RequireRoles("artist")(musicon.PutUploadChunk))))
+	router.POST("/api/v1/musicon/uploads/:uploadid/complete", rateLimiter.Limit(middleware.Authenticate(middleware.RequireRoles("artist")(musicon.CompleteUpload))))
+	router.DELETE("/api/v1/musicon/uploads/:uploadid", rateLimiter.Limit(middleware.Authenticate(middleware.RequireRoles("artist")(musicon.AbortUpload))))
 
 	// --------------------------- ALBUMS ---------------------------
 	router.GET("/api/v1/musicon/albums", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetAlbums)))
+	router.GET("/api/v1/musicon/songs", rateLimiter.Limit(middleware.OptionalAuth(musicon.ListSongs)))
+	router.GET("/api/v1/musicon/artists", rateLimiter.Limit(middleware.OptionalAuth(musicon.ListArtists)))
 	router.GET("/api/v1/musicon/albums/:albumid/songs", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetAlbumSongs)))
 	router.GET("/api/v1/musicon/recommended/albums", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetRecommendedAlbums)))
 
 	// --------------------------- SONGS & RECOMMENDATIONS ---------------------------
 	router.GET("/api/v1/musicon/recommended", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetRecommendedSongs)))
 
+	// Search across songs, albums, artists and public playlists
+	router.GET("/api/v1/musicon/search", rateLimiter.Limit(middleware.OptionalAuth(musicon.Search)))
+	router.GET("/api/v1/musicon/suggest", rateLimiter.Limit(middleware.OptionalAuth(musicon.Suggest)))
+
+	// Charts: ?window=day|week|month, optional ?genre= or ?language=
+	router.GET("/api/v1/musicon/charts/:type", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetChart)))
+
+	// Discovery seeded by a song
+	router.GET("/api/v1/musicon/songs/:songid/similar", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetSimilarSongs)))
+	router.GET("/api/v1/musicon/songs/:songid/radio", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetSongRadio)))
+
+	// Audio streaming with Range support
+	router.GET("/api/v1/musicon/songs/:songid/stream", rateLimiter.Limit(middleware.OptionalAuth(musicon.StreamSong)))
+	router.HEAD("/api/v1/musicon/songs/:songid/stream", rateLimiter.Limit(middleware.OptionalAuth(musicon.StreamSong)))
+
+	// HLS packaging and adaptive streaming
+	router.POST("/api/v1/musicon/songs/:songid/hls", rateLimiter.Limit(middleware.Authenticate(musicon.PackageSongHLS)))
+	router.GET("/api/v1/musicon/songs/:songid/hls", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetSongHLS)))
+	router.GET("/api/v1/musicon/songs/:songid/hls/:token/*file", rateLimiter.Limit(middleware.OptionalAuth(musicon.ServeSongHLS)))
+
+	// Play reporting and listening history
+	router.POST("/api/v1/musicon/songs/:songid/plays", rateLimiter.Limit(middleware.Authenticate(musicon.ReportPlay)))
+	router.GET("/api/v1/musicon/user/history", rateLimiter.Limit(middleware.Authenticate(musicon.GetRecentlyPlayed)))
+
 	// Dynamic personalized recommendations
 	router.GET("/api/v1/musicon/recommendations", rateLimiter.Limit(middleware.OptionalAuth(musicon.GetRecommendations)))
 }